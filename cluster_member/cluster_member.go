@@ -9,26 +9,35 @@ import (
 )
 
 func main() {
-	// Parse command line flag.
+	// Parse command line flags for the configuration file and the overrides of its fields.
 	path := flag.String("config", "", "path to configuration file")
+	printConfig := flag.Bool("print-config", false, "print the merged and validated configuration with secrets redacted and exit")
+	util.RegisterConfigFlags(flag.CommandLine)
 	flag.Parse()
-	if *path == "" {
+	if *path == "" && !util.HasConfigOverrides() {
 		fmt.Fprintf(os.Stderr, "configuration file missing, please provide it using the -config flag\n")
 		os.Exit(1)
 	}
 
-	// Load config.
+	// Load config. Encrypted secret keys are unlocked here, before the terminal user interface starts.
 	config, err := util.GetConfig(*path)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error loading config: %v\n", err)
 		os.Exit(1)
 	}
+	if *printConfig {
+		if err := util.PrintConfig(os.Stdout, config); err != nil {
+			fmt.Fprintf(os.Stderr, "error printing config: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Initialize TCP transport.
+	// Initialize transport to the routing server.
 	msgChan := make(chan util.Message)
-	transport, err := util.NewTCPTransport(config.Server, msgChan, config.GetMemberID(), *config.ClusterID)
+	transport, err := util.NewTransport(config, msgChan)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "unable to connect to routing server (is it running?): %v\n", err)
+		fmt.Fprintf(os.Stderr, "unable to connect (is the routing server running?): %v\n", err)
 		os.Exit(1)
 	}
 
@@ -38,6 +47,7 @@ func main() {
 		SenderName: config.Name,
 		Type:       util.MemberAuthMsg,
 		ClusterID:  *config.ClusterID,
+		To:         util.ToServer(),
 	})
 
 	// Initialize cluster protocol session.
@@ -45,8 +55,23 @@ func main() {
 	session.Init()
 	go session.MessageHandler()
 
-	// Start Terminal User Interface.
+	// Reload the configuration when the file changes or on SIGHUP.
+	util.WatchConfig(*path, config, func(config util.BaseConfig, change util.ConfigChange) {
+		session.Reload(config, change.ClusterCrypto)
+	})
+
+	// Start Terminal User Interface, unless the standard input and output carry the messages.
+	if util.IsStdioAddress(config.Server) {
+		util.StartHeadless()
+		return
+	}
 	util.StartTUI(func(line string) {
 		session.SendText(line)
+	}, util.TUICommand{
+		Name: "verify",
+		Help: "show the safety number of the cluster and the fingerprints of the members' keys",
+		Run: func(string) {
+			session.Verify()
+		},
 	})
 }
@@ -0,0 +1,137 @@
+package cluster_protocol
+
+import (
+	"crypto/sha256"
+	"pqgch/util"
+	"slices"
+	"sync"
+)
+
+// Text message kept in the mailbox. Only the ciphertext is stored, the mailbox never sees the plaintext.
+type mailboxEntry struct {
+	SenderName string `json:"sender"`
+	Content    string `json:"content"`
+}
+
+const (
+	mailboxEpochs = 3    // Number of epochs the mailbox keeps messages of, including the current one.
+	maxSeenTexts  = 1024 // Number of displayed text messages remembered per epoch.
+)
+
+// Mailbox retains the text messages of the recent epochs, so members who connect later can read them.
+// Our own messages are stored from the TUI goroutine, so the mailbox is safe for concurrent use.
+type mailbox struct {
+	mu       sync.Mutex
+	capacity int                       // Maximal number of messages kept per epoch.
+	epoch    string                    // Current epoch, empty until the Main Session Key is established.
+	epochs   []string                  // Epochs we keep messages of, oldest first.
+	entries  map[string][]mailboxEntry // Epoch ID -> messages sent in that epoch.
+}
+
+func newMailbox(capacity int) *mailbox {
+	return &mailbox{
+		capacity: capacity,
+		entries:  make(map[string][]mailboxEntry),
+	}
+}
+
+// Store the ciphertext of the text message under the epoch it was sent in.
+// Messages of senders that do not tell the epoch are assumed to belong to the current one,
+// and are dropped while we do not know it yet.
+func (m *mailbox) store(msg util.Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	epoch := msg.Epoch
+	if epoch == "" {
+		epoch = m.epoch
+	}
+	if epoch == "" {
+		return
+	}
+	m.add(epoch)
+	entry := mailboxEntry{SenderName: msg.SenderName, Content: msg.Content}
+	m.entries[epoch] = m.trim(append(m.entries[epoch], entry))
+}
+
+// Start a new epoch. Messages which arrived before we learned it are already kept under it.
+func (m *mailbox) setEpoch(epoch string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.epoch = epoch
+	if i := slices.Index(m.epochs, epoch); i >= 0 {
+		m.epochs = slices.Delete(m.epochs, i, i+1)
+	}
+	m.epochs = append(m.epochs, epoch)
+	if _, found := m.entries[epoch]; !found {
+		m.entries[epoch] = nil
+	}
+	m.expire()
+}
+
+// Start keeping messages of the epoch, if we do not already.
+func (m *mailbox) add(epoch string) {
+	if _, found := m.entries[epoch]; found {
+		return
+	}
+	m.epochs = append(m.epochs, epoch)
+	m.entries[epoch] = nil
+	m.expire()
+}
+
+// Drop the messages of the oldest epochs over mailboxEpochs. The current epoch is never dropped.
+func (m *mailbox) expire() {
+	for len(m.epochs) > mailboxEpochs {
+		i := 0
+		if m.epochs[0] == m.epoch {
+			i = 1
+		}
+		delete(m.entries, m.epochs[i])
+		m.epochs = slices.Delete(m.epochs, i, i+1)
+	}
+}
+
+func (m *mailbox) backlog(epoch string) []mailboxEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Clone(m.entries[epoch])
+}
+
+// Drop the oldest messages over capacity.
+func (m *mailbox) trim(entries []mailboxEntry) []mailboxEntry {
+	if len(entries) > m.capacity {
+		return entries[len(entries)-m.capacity:]
+	}
+	return entries
+}
+
+// Text messages displayed in the current epoch, identified by their ciphertext, so we do not display
+// a message twice when it arrives both directly and as part of the mailbox backlog.
+// Only the most recent maxSeenTexts messages are remembered, as the backlog is bounded as well.
+type seenTexts struct {
+	epoch   string
+	digests map[[sha256.Size]byte]bool
+	order   [][sha256.Size]byte // Digests in the order they were seen, oldest first.
+}
+
+func (s *seenTexts) has(epoch, content string) bool {
+	return s.epoch == epoch && s.digests[sha256.Sum256([]byte(content))]
+}
+
+// Remember the text message. The messages of the previous epochs are forgotten.
+func (s *seenTexts) add(epoch, content string) {
+	if s.epoch != epoch || s.digests == nil {
+		s.epoch = epoch
+		s.digests = make(map[[sha256.Size]byte]bool)
+		s.order = nil
+	}
+	if len(s.order) >= maxSeenTexts {
+		delete(s.digests, s.order[0])
+		s.order = s.order[1:]
+	}
+	digest := sha256.Sum256([]byte(content))
+	s.digests[digest] = true
+	s.order = append(s.order, digest)
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -25,6 +26,8 @@ type CryptoSession struct {
 	commitments       []gake.Commitment    // The commitment is a result of hashing the Xi and Ri together. They are then broadcasted by each participant.
 	rs                [][gake.CoinLen]byte // Rs - each Ri is randomly generated by each participant.
 	pids              []string             // Party identifiers - the usernames of others received as part of the messages.
+	gakeKey           [2 * gake.SsLen]byte // Key established by Kyber-GAKE.
+	qkdKey            [2 * gake.SsLen]byte // Key established by QKD.
 	clusterSessionKey [2 * gake.SsLen]byte // The resulting cluster session key used for intra-cluster communication.
 }
 
@@ -49,6 +52,29 @@ type Session struct {
 	// This ciphertext is to be received from the cluster leader.
 	// If the session user is a cluster leader, the cluster leader uses the cluster session key
 	// to encrypt and distribute the main session key. The main session key is created by the leader_protocol.
+	mailbox *mailbox            // Text messages kept for members who connect later. Only cluster leaders with mailbox enabled have one.
+	seen    seenTexts           // Text messages of the current epoch we have already displayed.
+	updates chan configUpdate   // Here we receive the reloaded configuration.
+	verify  chan chan struct{}  // Here we receive the requests to show the keys to verify, closing the channel once they are shown.
+	qkdPool *util.KeyPool       // Prefetched cluster QKD keys. Only cluster leaders requesting keys from a KME have one.
+	members util.ClusterMembers // Roster and public keys of the members, loaded with the configuration.
+	round   int64               // Round of our run of the protocol, stamped on its messages.
+	rekeyed bool                // We started or joined a later run, so messages of older rounds are dropped.
+}
+
+// Configuration reloaded while running.
+type configUpdate struct {
+	config util.BaseConfig
+	rekey  bool // The cryptographic inputs changed, so a new Cluster Session Key has to be established.
+}
+
+// Load the members of the cluster on start, when there is no running configuration to fall back to.
+func loadMembers(config util.BaseConfig) util.ClusterMembers {
+	members, err := config.Cluster.LoadMembers()
+	if err != nil {
+		util.ExitWithMsg(err.Error())
+	}
+	return members
 }
 
 // Create a new Cluster Member session.
@@ -61,6 +87,10 @@ func NewSession(
 		sender:      sender,
 		crypto:      NewCryptoSession(config),
 		config:      config,
+		updates:     make(chan configUpdate),
+		verify:      make(chan chan struct{}),
+		members:     loadMembers(config),
+		round:       util.NewRound(0),
 	}
 
 	s.transportMainSessionKey = func() {
@@ -84,6 +114,8 @@ func NewLeaderSession(
 			receiveChan: receiveChan,
 			sender:      sender,
 			config:      config,
+			updates:     make(chan configUpdate),
+			verify:      make(chan chan struct{}),
 		}
 	}
 
@@ -92,6 +124,14 @@ func NewLeaderSession(
 		sender:      sender,
 		crypto:      NewCryptoSession(config),
 		config:      config,
+		updates:     make(chan configUpdate),
+		verify:      make(chan chan struct{}),
+		members:     loadMembers(config),
+		round:       util.NewRound(0),
+	}
+
+	if config.HasMailbox() {
+		s.mailbox = newMailbox(config.Leader.MailboxSize)
 	}
 
 	s.transportMainSessionKey = func() {
@@ -110,9 +150,11 @@ func NewLeaderSession(
 		msg := util.Message{
 			SenderID:   s.config.GetMemberID(),
 			ClusterID:  *s.config.ClusterID,
+			To:         util.ToCluster(*s.config.ClusterID),
 			Type:       util.KeyMsg,
 			Content:    key,
 			SenderName: s.config.Name,
+			Round:      s.round,
 		}
 
 		s.sender.Send(msg)
@@ -124,43 +166,162 @@ func NewLeaderSession(
 // Initialize the session by sending the first message of the 2-AKE to the neighbor,
 // or by retrieving the QKD key.
 func (s *Session) Init() {
-	if !s.config.HasCluster() || s.config.Cluster.HasQKDUrl() {
+	if !s.config.HasCluster() {
 		return
 	}
 
+	if s.members.Roster != nil {
+		for _, m := range s.members.Roster.Members {
+			util.LogInfo(fmt.Sprintf("Roster: member %d is %s, key %s", m.ID, m.Name, m.Fingerprint()))
+		}
+	}
+	if roster := s.members.VerificationRoster(); roster != nil {
+		util.LogInfo(fmt.Sprintf("Cluster safety number: %s, type /verify to compare it", roster.SafetyNumber()))
+	}
+
 	if s.config.Cluster.IsClusterQKDPath() {
 		key, err := s.config.Cluster.ClusterQKDKeyFromFile()
 		if err != nil {
 			util.ExitWithMsg(fmt.Sprintf("failed loading cluster QKD key: %v", err))
 		}
-		s.crypto.clusterSessionKey = key
+		s.crypto.qkdKey = key
+		s.establishClusterKey()
+	}
 
-		util.LogCrypto(fmt.Sprintf("Cluster Session Key established: %02x...", s.crypto.clusterSessionKey[:4]))
-		s.transportMainSessionKey()
+	// The cluster leader takes the key from the KME and tells the members its ID.
+	if s.config.Leader != nil && s.config.Cluster.HasQKDUrl() {
+		s.requestQKDKey()
+	}
+
+	if !s.config.Cluster.UsesKyber() {
 		return
 	}
 
-	akeSendARight, tk, eska := gake.KexAkeInitA(s.config.Cluster.GetPublicKeys()[s.config.Cluster.RightMemberID()])
+	akeSendARight, tk, eska := gake.KexAkeInitA(s.members.PublicKeys[s.config.Cluster.RightMemberID()])
 	s.crypto.tkRight, s.crypto.eskaRight = tk, eska
 
 	msg := util.Message{
 		SenderID:   s.config.GetMemberID(),
 		SenderName: s.config.Name,
 		Type:       util.AkeOneMsg,
-		ReceiverID: s.config.Cluster.RightMemberID(),
+		To:         util.ToMember(*s.config.ClusterID, s.config.Cluster.RightMemberID()),
 		ClusterID:  *s.config.ClusterID,
 		Content:    base64.StdEncoding.EncodeToString(akeSendARight),
+		Round:      s.round,
 	}
 	go s.sender.Send(msg)
 }
 
 func (s *Session) MessageHandler() {
-	for msg := range s.receiveChan {
-		if !s.config.HasCluster() && msg.Type != util.MainSessionKeyMsg && msg.Type != util.TextMsg {
-			continue
+	for {
+		select {
+		case msg, ok := <-s.receiveChan:
+			if !ok {
+				return
+			}
+			if !s.config.HasCluster() && msg.Type != util.MainSessionKeyMsg && msg.Type != util.TextMsg {
+				clear(msg.Key)
+				continue
+			}
+			s.handleMessage(msg)
+		case update := <-s.updates:
+			s.applyConfig(update)
+		case done := <-s.verify:
+			s.showVerification()
+			close(done)
+		}
+	}
+}
+
+// Apply the reloaded configuration. It is handed over to the message handler, so the configuration
+// does not change while a message is processed. If rekey is set, a new run of the protocol is started.
+func (s *Session) Reload(config util.BaseConfig, rekey bool) {
+	s.updates <- configUpdate{config: config, rekey: rekey && config.HasCluster()}
+}
+
+func (s *Session) applyConfig(update configUpdate) {
+	members, err := update.config.Cluster.LoadMembers()
+	if err != nil {
+		util.LogError(fmt.Sprintf("Keeping the running configuration: %v", err))
+		return
+	}
+	s.config, s.members = update.config, members
+
+	if s.qkdPool != nil {
+		// The KME settings may have changed, so the pool is created again for the next key.
+		s.qkdPool.Close()
+		s.qkdPool = nil
+		if !update.rekey && s.crypto.qkdKey == [2 * gake.SsLen]byte{} {
+			s.requestQKDKey()
+		}
+	}
+
+	if update.rekey {
+		util.LogCrypto("Cluster keys changed, rekeying the cluster")
+		s.rekey(util.NewRound(s.round))
+	}
+}
+
+// Start or join the run of the protocol with the given round, using the current configuration. The Main Session Key is kept,
+// so the chat continues until the new Cluster Session Key is established and the key is distributed again.
+func (s *Session) rekey(round int64) {
+	s.round, s.rekeyed = round, true
+	s.crypto = NewCryptoSession(s.config)
+	s.keyCiphertext = nil
+	s.Init()
+}
+
+// With a roster, the messages from the members of our cluster have to carry the name the roster gives their sender.
+// Messages passed between our own sessions and messages from other clusters are not checked.
+func (s *Session) checkSender(recv util.Message) error {
+	if s.members.Roster == nil || recv.ClusterID != *s.config.ClusterID {
+		return nil
+	}
+	switch recv.Type {
+	case util.MainSessionKeyMsg, util.QKDClusterKeyMsg:
+		return nil
+	}
+	return s.members.Roster.CheckSender(recv.SenderID, recv.SenderName)
+}
+
+// Report whether our run of the protocol has established the Cluster Session Key.
+func (s *Session) finished() bool {
+	return s.crypto.clusterSessionKey != [2 * gake.SsLen]byte{}
+}
+
+// Report whether the message belongs to an older run of the protocol than ours, or repeats a message of our run
+// after it has finished, for example a late duplicate or a message replayed by the mesh history.
+// The participants start their first run at different times, so until it finishes, messages of older rounds are accepted.
+func (s *Session) isStale(recv util.Message) bool {
+	if recv.Round == 0 {
+		return false // Not part of a run, for example a text message.
+	}
+	if !util.PlausibleRound(recv.Round) {
+		return true
+	}
+	switch {
+	case recv.Round < s.round:
+		return s.finished() || s.rekeyed
+	case recv.Round == s.round && s.finished():
+		switch recv.Type {
+		case util.AkeOneMsg, util.AkeTwoMsg, util.XiRiCommitmentMsg, util.QKDIDMemberMsg, util.QKDClusterKeyMsg:
+			return true
 		}
-		s.handleMessage(msg)
 	}
+	return false
+}
+
+// Report whether the message starts a run of the protocol with a newer round than ours after our first run,
+// which means the sender is rekeying the cluster and we have to join it.
+func (s *Session) startsNewRun(recv util.Message) bool {
+	if recv.Round <= s.round || !(s.finished() || s.rekeyed) {
+		return false
+	}
+	switch recv.Type {
+	case util.AkeOneMsg, util.XiRiCommitmentMsg, util.QKDIDMemberMsg:
+		return true
+	}
+	return false
 }
 
 // Process the first message of 2-AKE, holding as a result keyLeft. The second message of 2-AKE is then sent.
@@ -176,7 +337,7 @@ func (s *Session) onAkeOne(msg util.Message) {
 	akeSendB, s.crypto.keyLeft = gake.KexAkeSharedB(
 		akeSendA,
 		s.config.Cluster.GetSecretKey(),
-		s.config.Cluster.GetPublicKeys()[msg.SenderID])
+		s.members.PublicKeys[msg.SenderID])
 
 	util.LogCrypto("Established 2-AKE shared key with left neighbor")
 
@@ -184,9 +345,10 @@ func (s *Session) onAkeOne(msg util.Message) {
 		SenderID:   s.config.GetMemberID(),
 		SenderName: s.config.Name,
 		Type:       util.AkeTwoMsg,
-		ReceiverID: msg.SenderID,
+		To:         util.ToMember(msg.ClusterID, msg.SenderID),
 		ClusterID:  *s.config.ClusterID,
 		Content:    base64.StdEncoding.EncodeToString(akeSendB),
+		Round:      msg.Round, // The round of the message we answer, so an answer to an earlier run is dropped.
 	}
 	s.sender.Send(msg)
 
@@ -251,25 +413,98 @@ func (s *Session) onKey(recv util.Message) {
 }
 
 // Handle a text message - we decrypt it using the main session key and print.
+// If we keep a mailbox, we also store the ciphertext for members who connect later.
 func (s *Session) onText(recv util.Message) {
+	if s.mailbox != nil {
+		s.mailbox.store(recv)
+	}
 	if s.mainSessionKey == [gake.SsLen]byte{} {
 		util.LogCrypto("No Main Session Key yet. Skipping message.")
 		return
 	}
-	plainText, err := decryptAesGcm(recv.Content, s.mainSessionKey[:])
+	if recv.Epoch != "" && recv.Epoch != util.EpochID(s.mainSessionKey) {
+		util.LogCrypto(fmt.Sprintf("Skipping message from %s encrypted in another epoch.", recv.SenderName))
+		return
+	}
+	s.displayText(recv.SenderName, recv.Content)
+}
+
+// Decrypt and print the text message, unless we have already displayed it.
+func (s *Session) displayText(senderName, content string) {
+	epoch := util.EpochID(s.mainSessionKey)
+	if s.seen.has(epoch, content) {
+		return
+	}
+	plainText, err := decryptAesGcm(content, s.mainSessionKey[:])
 	if err != nil {
 		util.LogError(fmt.Sprint("Failed decrypting message:", err))
 		return
 	}
-	text := fmt.Sprintf("%s: %s", recv.SenderName, plainText)
+	s.seen.add(epoch, content)
+	text := fmt.Sprintf("%s: %s", senderName, plainText)
 	util.PrintLineColored(text, util.ColorGreen)
 }
 
+// Handle a request for the mailbox backlog of the given epoch by sending the stored messages to the member.
+func (s *Session) onMailboxFetch(recv util.Message) {
+	if s.mailbox == nil {
+		return
+	}
+	backlog := s.mailbox.backlog(recv.Content)
+	content, err := json.Marshal(backlog)
+	if err != nil {
+		util.LogError(fmt.Sprintf("Failed to encode mailbox backlog: %v", err))
+		return
+	}
+
+	util.LogInfo(fmt.Sprintf("Sending %d stored messages to %s", len(backlog), recv.SenderName))
+	s.sender.Send(util.Message{
+		SenderID:   s.config.GetMemberID(),
+		SenderName: s.config.Name,
+		Type:       util.MailboxMsg,
+		To:         util.ToMember(recv.ClusterID, recv.SenderID),
+		ClusterID:  *s.config.ClusterID,
+		Content:    string(content),
+	})
+}
+
+// Handle the mailbox backlog by decrypting and printing the messages we have not seen yet.
+func (s *Session) onMailbox(recv util.Message) {
+	if s.mainSessionKey == [gake.SsLen]byte{} {
+		return
+	}
+	var backlog []mailboxEntry
+	if err := json.Unmarshal([]byte(recv.Content), &backlog); err != nil {
+		util.LogError(fmt.Sprintf("Invalid mailbox backlog received: %v", err))
+		return
+	}
+	util.LogInfo(fmt.Sprintf("Received %d stored messages from the mailbox", len(backlog)))
+	for _, entry := range backlog {
+		s.displayText(entry.SenderName, entry.Content)
+	}
+}
+
+// Ask the cluster leader for the messages sent in the current epoch before we could read them.
+func (s *Session) fetchBacklog() {
+	go s.sender.Send(util.Message{
+		SenderID:   s.config.GetMemberID(),
+		SenderName: s.config.Name,
+		Type:       util.MailboxFetchMsg,
+		To:         util.ToLeader(*s.config.ClusterID),
+		ClusterID:  *s.config.ClusterID,
+		Content:    util.EpochID(s.mainSessionKey),
+	})
+}
+
 // Handle main session key message from leader_protocol. Store it and distribute to cluster.
 func (s *Session) onMainSessionKey(recv util.Message) {
 	decoded, _ := base64.StdEncoding.DecodeString(recv.Content)
 	copy(s.mainSessionKey[:], decoded)
 
+	if s.mailbox != nil {
+		s.mailbox.setEpoch(util.EpochID(s.mainSessionKey))
+	}
+
 	if s.config.HasCluster() {
 		s.transportMainSessionKey()
 	}
@@ -277,25 +512,115 @@ func (s *Session) onMainSessionKey(recv util.Message) {
 
 // Handle receiving of the QKD cluster key from ETSI server.
 func (s *Session) onQKDClusterKey(msg util.Message) {
-	decoded, _ := base64.StdEncoding.DecodeString(msg.Content)
-	util.LogCrypto(fmt.Sprintf("Established Cluster Session Key via QKD: %02x…", decoded[:4]))
-	copy(s.crypto.clusterSessionKey[:], decoded)
+	if len(msg.Key) != util.QKDLinkCluster.KeySize() {
+		util.LogError(fmt.Sprintf("Invalid cluster QKD key of %d bytes", len(msg.Key)))
+		return
+	}
+	util.LogCrypto(fmt.Sprintf("Received cluster key via QKD: %02x…", msg.Key[:4]))
+	copy(s.crypto.qkdKey[:], msg.Key)
+	s.establishClusterKey()
+}
+
+// Establish the Cluster Session Key once all the keys required by the configuration are available.
+// In hybrid mode, the Kyber-GAKE key and the QKD key are combined through a KDF.
+func (s *Session) establishClusterKey() {
+	usesKyber := s.config.Cluster.UsesKyber()
+	usesQKD := !usesKyber || s.config.Cluster.IsHybrid()
+	if (usesKyber && s.crypto.gakeKey == [2 * gake.SsLen]byte{}) || (usesQKD && s.crypto.qkdKey == [2 * gake.SsLen]byte{}) {
+		return
+	}
+
+	switch {
+	case usesKyber && usesQKD:
+		s.crypto.clusterSessionKey = util.CombineClusterKeys(s.crypto.gakeKey, s.crypto.qkdKey)
+		util.LogCrypto("Combined Kyber-GAKE and QKD cluster keys")
+	case usesQKD:
+		s.crypto.clusterSessionKey = s.crypto.qkdKey
+	default:
+		s.crypto.clusterSessionKey = s.crypto.gakeKey
+	}
+
+	util.LogCrypto(fmt.Sprintf("Cluster Session Key established: %02x...", s.crypto.clusterSessionKey[:4]))
 	s.transportMainSessionKey()
 }
 
+// Take a cluster key from the KME in the background, deliver it to our message handler and tell the members its ID.
+func (s *Session) requestQKDKey() {
+	if s.qkdPool == nil {
+		s.qkdPool = s.config.QKDPool(util.QKDLinkCluster)
+	}
+	pool, config, round := s.qkdPool, s.config, s.round
+
+	go func() {
+		ctx, cancel := config.QKD.RetryPolicy().KeyContext()
+		defer cancel()
+		key, keyID, err := pool.Take(ctx)
+		if errors.Is(err, util.ErrPoolClosed) {
+			return // The configuration was reloaded, the key is requested from the new pool.
+		}
+		if err != nil {
+			util.LogError(fmt.Sprintf("Failed to retrieve cluster QKD key, aborting this run of the protocol: %v", err))
+			return
+		}
+
+		s.receiveChan <- util.Message{
+			Type:  util.QKDClusterKeyMsg,
+			Key:   key,
+			Round: round,
+		}
+
+		s.sender.Send(util.Message{
+			ClusterID:  *config.ClusterID,
+			To:         util.ToCluster(*config.ClusterID),
+			SenderID:   config.GetMemberID(),
+			SenderName: config.Name,
+			Type:       util.QKDIDMemberMsg,
+			Content:    keyID,
+			Round:      round,
+		})
+	}()
+}
+
 // Handle receiving of the QKD key ID by fetching our copy.
 func (s *Session) onQKDID(msg util.Message) {
+	client, policy, round := s.config.QKDClient(util.QKDLinkCluster), s.config.QKD.RetryPolicy(), s.round
 	go func() {
-		key := util.RequestKeyByID(s.config.Cluster.QKDUrl(), msg.Content)
+		ctx, cancel := policy.KeyContext()
+		defer cancel()
+		key, err := util.RequestKeyByID(ctx, client, msg.Content)
+		if err != nil {
+			util.LogError(fmt.Sprintf("Failed to retrieve cluster QKD key, aborting this run of the protocol: %v", err))
+			return
+		}
 		s.receiveChan <- util.Message{
-			Type:    util.QKDClusterKeyMsg,
-			Content: key,
+			Type:  util.QKDClusterKeyMsg,
+			Key:   key,
+			Round: round,
 		}
 	}()
 }
 
 // Handle the received message according to its type.
+// The key material of the message is erased once it is handled, even if the message is dropped.
 func (s *Session) handleMessage(recv util.Message) {
+	defer clear(recv.Key)
+	if err := s.checkSender(recv); err != nil {
+		util.LogError(fmt.Sprintf("Dropping %s: %v", recv.TypeName(), err))
+		return
+	}
+	if s.isStale(recv) {
+		util.LogCrypto(fmt.Sprintf("Dropping %s of an earlier run from %s", recv.TypeName(), recv.SenderName))
+		return
+	}
+	switch {
+	case s.startsNewRun(recv):
+		util.LogCrypto(fmt.Sprintf("%s is rekeying the cluster, joining", recv.SenderName))
+		s.rekey(recv.Round)
+	case recv.Round > s.round && !s.finished() && !s.rekeyed:
+		// The participants starting after us have newer rounds, our first run ends with the newest one.
+		s.round = recv.Round
+	}
+
 	switch recv.Type {
 	case util.AkeOneMsg:
 		s.onAkeOne(recv)
@@ -311,11 +636,51 @@ func (s *Session) handleMessage(recv util.Message) {
 		s.onQKDClusterKey(recv)
 	case util.QKDIDMemberMsg:
 		s.onQKDID(recv)
+	case util.MailboxFetchMsg:
+		s.onMailboxFetch(recv)
+	case util.MailboxMsg:
+		s.onMailbox(recv)
 	default:
 		s.onText(recv)
 	}
 }
 
+// Show the safety number of the cluster and the fingerprints of the public keys of its members,
+// so the members can check out of band that they all have the same names and keys.
+// They are shown by the message handler, so a configuration reloaded meanwhile is never shown half.
+func (s *Session) Verify() {
+	done := make(chan struct{})
+	s.verify <- done
+	<-done
+}
+
+func (s *Session) showVerification() {
+	if !s.config.HasCluster() {
+		util.PrintLine("We are the only member of our cluster, there are no cluster keys to verify.")
+		return
+	}
+	roster := s.members.VerificationRoster()
+	if roster == nil {
+		util.PrintLine(fmt.Sprintf("The cluster key comes from %s, there are no public keys to verify.", s.config.Cluster.Crypto.Kind))
+		return
+	}
+
+	util.PrintLine(fmt.Sprintf("Safety number of cluster %d: %s", *s.config.ClusterID, roster.SafetyNumber()))
+	for _, m := range roster.Members {
+		name := m.Name
+		if name == "" {
+			name = fmt.Sprintf("member %d", m.ID)
+		}
+		line := fmt.Sprintf("  %d %s: %s", m.ID, name, m.Fingerprint())
+		if m.ID == s.config.GetMemberID() {
+			line += " (you)"
+		}
+		util.PrintLine(line)
+	}
+	util.PrintLine("Compare the safety number with the other members out of band, for example in person or by phone. " +
+		"If it matches, you all have the same names and public keys.")
+}
+
 // Encrypt and send the text message.
 func (s *Session) SendText(text string) {
 	if s.mainSessionKey == [gake.SsLen]byte{} {
@@ -332,7 +697,12 @@ func (s *Session) SendText(text string) {
 		SenderName: s.config.Name,
 		Content:    cipherText,
 		ClusterID:  *s.config.ClusterID,
+		To:         util.ToAll(),
 		Type:       util.TextMsg,
+		Epoch:      util.EpochID(s.mainSessionKey),
+	}
+	if s.mailbox != nil {
+		s.mailbox.store(msg)
 	}
 	go s.sender.Send(msg)
 }
@@ -342,7 +712,8 @@ func (s *Session) SendText(text string) {
 func (s *Session) checkLeftRightKeys() util.Message {
 	if s.crypto.keyRight != [gake.SsLen]byte{} && s.crypto.keyLeft != [gake.SsLen]byte{} {
 		util.LogCrypto("Established 2-AKE shared keys with both neighbors")
-		msg := getXiCommitmentCoinMsg(&s.crypto, s.config)
+		msg := getXiCommitmentCoinMsg(&s.crypto, s.config, s.members.PublicKeys[s.config.GetMemberID()])
+		msg.Round = s.round
 		s.tryFinalizeProtocol()
 		return msg
 	}
@@ -355,12 +726,12 @@ func (s *Session) checkLeftRightKeys() util.Message {
 // Generate a random Ri.
 // Compute the commitment as a public key encryption of Xi, Ri and i (index of current party).
 // Save the values for our use and also return a message containing them, so we can send it to other protocol participants.
-func getXiCommitmentCoinMsg(session *CryptoSession, config util.BaseConfig) util.Message {
+func getXiCommitmentCoinMsg(session *CryptoSession, config util.BaseConfig, publicKey [gake.PkLen]byte) util.Message {
 	xi := gake.XorKeys(session.keyRight, session.keyLeft)
 	ri := gake.GetRi()
 	commitment := computeCommitment(
 		config.GetMemberID(),
-		config.Cluster.GetPublicKeys()[config.GetMemberID()],
+		publicKey,
 		xi,
 		ri)
 
@@ -381,6 +752,7 @@ func getXiCommitmentCoinMsg(session *CryptoSession, config util.BaseConfig) util
 		SenderName: config.Name,
 		Type:       util.XiRiCommitmentMsg,
 		ClusterID:  *config.ClusterID,
+		To:         util.ToCluster(*config.ClusterID),
 		Content:    base64.StdEncoding.EncodeToString(content),
 	}
 
@@ -427,12 +799,19 @@ func (s *Session) tryFinalizeProtocol() {
 	}
 	util.LogCrypto("Xs check: success")
 
-	ok = checkCommitments(s.crypto.xs, s.config.Cluster.GetPublicKeys(), s.crypto.rs, s.crypto.commitments)
+	ok = checkCommitments(s.crypto.xs, s.members.PublicKeys, s.crypto.rs, s.crypto.commitments)
 	if !ok {
 		util.ExitWithMsg("Failed Commitments check")
 	}
 	util.LogCrypto("Commitments check: success")
 
+	if s.members.Roster != nil {
+		// The roster is authoritative, the names received in the messages were already checked against it.
+		for i, m := range s.members.Roster.Members {
+			s.crypto.pids[i] = m.Name
+		}
+	}
+
 	util.LogCrypto(fmt.Sprintf("Establishing Cluster Session Key for Group: %s", s.crypto.pids))
 	PIDs := make([][gake.PidLen]byte, *s.config.Cluster.NMembers)
 	for i, n := range s.crypto.pids {
@@ -442,10 +821,9 @@ func (s *Session) tryFinalizeProtocol() {
 	}
 
 	otherLeftKeys := util.ComputeAllLeftKeys(*s.config.Cluster.NMembers, s.config.GetMemberID(), s.crypto.keyLeft, s.crypto.xs, PIDs)
-	s.crypto.clusterSessionKey = computeSharedSecret(otherLeftKeys, PIDs, *s.config.Cluster.NMembers)
-	util.LogCrypto(fmt.Sprintf("Cluster Session Key established: %02x...", s.crypto.clusterSessionKey[:4]))
+	s.crypto.gakeKey = computeSharedSecret(otherLeftKeys, PIDs, *s.config.Cluster.NMembers)
 
-	s.transportMainSessionKey()
+	s.establishClusterKey()
 }
 
 func (s *Session) decryptAndStoreKey(content []byte) {
@@ -458,6 +836,8 @@ func (s *Session) decryptAndStoreKey(content []byte) {
 
 	util.LogCrypto(fmt.Sprintf("Main Session Key established: %02x...", s.mainSessionKey[:4]))
 	util.LogCrypto("You can now securely chat!")
+
+	s.fetchBacklog()
 }
 
 // Recalculate the commitments and compare them to the received ones.
@@ -10,6 +10,7 @@ enum {
     GoKyberK    = KYBER_K,
     GoPkLen     = KYBER_PUBLICKEYBYTES,
     GoSkLen     = KYBER_SECRETKEYBYTES,
+    GoIndcpaSk  = KYBER_INDCPA_SECRETKEYBYTES,
     GoCtKemLen  = KYBER_CIPHERTEXTBYTES,
     GoSsBytes   = KYBER_SSBYTES
 };
@@ -54,6 +55,8 @@ const (
 	PidLen   = 20
 	AkeSendB = 2 * CtKemLen
 	AkeSendA = PkLen + CtKemLen
+
+	indcpaSkLen = int(C.GoIndcpaSk)
 )
 
 type KemKeyPair struct {
@@ -78,6 +81,11 @@ func GetKemKeyPair() KemKeyPair {
 	return KemKeyPair{pk, sk}
 }
 
+// The KEM secret key contains its public key right after the IND-CPA secret key.
+func PublicKeyOf(sk [SkLen]byte) [PkLen]byte {
+	return [PkLen]byte(sk[indcpaSkLen : indcpaSkLen+PkLen])
+}
+
 func KexAkeInitA(pkb [PkLen]byte) ([]byte, []byte, []byte) {
 	var ake_senda [AkeSendA]byte
 	var tk [SsLen]byte
@@ -2,6 +2,10 @@ module pqgch
 
 go 1.22
 
-require golang.org/x/term v0.29.0
+require (
+	golang.org/x/crypto v0.33.0
+	golang.org/x/net v0.35.0
+	golang.org/x/term v0.29.0
+)
 
 require golang.org/x/sys v0.30.0 // indirect
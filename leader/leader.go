@@ -30,26 +30,35 @@ func demuxMessages(in <-chan util.Message) (chan util.Message, chan util.Message
 }
 
 func main() {
-	// Parse command line flag for configuration filename.
+	// Parse command line flags for the configuration file and the overrides of its fields.
 	path := flag.String("config", "", "path to configuration file")
+	printConfig := flag.Bool("print-config", false, "print the merged and validated configuration with secrets redacted and exit")
+	util.RegisterConfigFlags(flag.CommandLine)
 	flag.Parse()
-	if *path == "" {
+	if *path == "" && !util.HasConfigOverrides() {
 		fmt.Fprintf(os.Stderr, "configuration file missing, please provide it using the -config flag\n")
 		os.Exit(1)
 	}
 
-	// Load config.
+	// Load config. Encrypted secret keys are unlocked here, before the terminal user interface starts.
 	config, err := util.GetConfig(*path)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error loading config: %v\n", err)
 		os.Exit(1)
 	}
+	if *printConfig {
+		if err := util.PrintConfig(os.Stdout, config); err != nil {
+			fmt.Fprintf(os.Stderr, "error printing config: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Initialize TCP transport.
+	// Initialize transport to the routing server.
 	msgChan := make(chan util.Message)
-	transport, err := util.NewTCPTransport(config.Server, msgChan, config.GetMemberID(), *config.ClusterID)
+	transport, err := util.NewTransport(config, msgChan)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "unable to connect to routing server (is it running?): %v\n", err)
+		fmt.Fprintf(os.Stderr, "unable to connect (is the routing server running?): %v\n", err)
 		os.Exit(1)
 	}
 
@@ -59,6 +68,7 @@ func main() {
 		SenderName: config.Name,
 		Type:       util.LeaderAuthMsg,
 		ClusterID:  *config.ClusterID,
+		To:         util.ToServer(),
 	})
 
 	// Create channels for both sessions.
@@ -86,49 +96,25 @@ func main() {
 	go leaderSession.MessageHandler()
 	go clusterSession.MessageHandler()
 
-	if config.Cluster.HasQKDUrl() {
-		go func() {
-			key, keyID := util.RequestKey(config.Cluster.QKDUrl())
-
-			msgsCluster <- util.Message{
-				Type:    util.QKDClusterKeyMsg,
-				Content: key,
-			}
-
-			transport.Send(util.Message{
-				ClusterID:  *config.ClusterID,
-				SenderID:   config.GetMemberID(),
-				SenderName: config.Name,
-				Type:       util.QKDIDMemberMsg,
-				Content:    keyID,
-			})
-		}()
-	}
-
-	// If two leaders use QKD, one of them (this one) fetches the key
-	// and sends the key ID to his right neighbor.
-	if config.Leader.HasRightQKDUrl() {
-		go func() {
-			key, keyID := util.RequestKey(config.Leader.RightQKDUrl())
-
-			msgsLeader <- util.Message{
-				Type:    util.QKDRightKeyMsg,
-				Content: key,
-			}
+	// Reload the configuration when the file changes or on SIGHUP.
+	util.WatchConfig(*path, config, func(config util.BaseConfig, change util.ConfigChange) {
+		leaderSession.Reload(config, change.LeaderCrypto)
+		clusterSession.Reload(config, change.ClusterCrypto)
+	})
 
-			transport.Send(util.Message{
-				ClusterID:  *config.ClusterID,
-				SenderID:   config.GetMemberID(),
-				ReceiverID: config.RightClusterID(),
-				SenderName: config.Name,
-				Type:       util.QKDIDLeaderMsg,
-				Content:    keyID,
-			})
-		}()
+	// Start Terminal User Interface, unless the standard input and output carry the messages.
+	if util.IsStdioAddress(config.Server) {
+		util.StartHeadless()
+		return
 	}
-
-	// Start Terminal User Interface.
 	util.StartTUI(func(line string) {
 		clusterSession.SendText(line)
+	}, util.TUICommand{
+		Name: "verify",
+		Help: "show the safety number of the cluster and the fingerprints of the cluster and leader keys",
+		Run: func(string) {
+			clusterSession.Verify()
+			leaderSession.Verify()
+		},
 	})
 }
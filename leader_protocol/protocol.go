@@ -3,6 +3,7 @@ package leader_protocol
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"pqgch/gake"
 	"pqgch/util"
@@ -13,6 +14,10 @@ import (
 type CryptoSession struct {
 	tkRight     []byte               // 2-AKE temporary material.
 	eskaRight   []byte               // 2-AKE temporary material.
+	akeLeft     [gake.SsLen]byte     // 2-AKE key with the left neighbor.
+	akeRight    [gake.SsLen]byte     // 2-AKE key with the right neighbor.
+	qkdLeft     [gake.SsLen]byte     // QKD key with the left neighbor.
+	qkdRight    [gake.SsLen]byte     // QKD key with the right neighbor.
 	keyLeft     [gake.SsLen]byte     // Shared secret with the left neighbor.
 	keyRight    [gake.SsLen]byte     // Shared secret with the right neighbor.
 	xs          [][gake.SsLen]byte   // Xs - each Xi is the result of XOR-ing the left and right key of each protocol participant.
@@ -36,6 +41,17 @@ type Session struct {
 	config             util.BaseConfig    // Our configuration.
 	crypto             CryptoSession      // Crypto state.
 	clusterSessionChan chan util.Message  // Here we send the established main session key.
+	updates            chan configUpdate  // Here we receive the reloaded configuration.
+	verify             chan chan struct{} // Here we receive the requests to show the keys to verify, closing the channel once they are shown.
+	qkdPool            *util.KeyPool      // Prefetched QKD keys of the link with the right neighbor, if it uses a KME.
+	round              int64              // Round of our run of the protocol, stamped on its messages.
+	rekeyed            bool               // We started or joined a later run, so messages of older rounds are dropped.
+}
+
+// Configuration reloaded while running.
+type configUpdate struct {
+	config util.BaseConfig
+	rekey  bool // The cryptographic inputs changed, so a new Main Session Key has to be established.
 }
 
 // Create a new Cluster Leader session.
@@ -47,6 +63,9 @@ func NewSession(sender util.MessageSender, config util.BaseConfig, clusterSessio
 		crypto:             NewCryptoSession(*config.Leader.NClusters),
 		config:             config,
 		clusterSessionChan: clusterSessionChan,
+		updates:            make(chan configUpdate),
+		verify:             make(chan chan struct{}),
+		round:              util.NewRound(0),
 	}
 
 	return s
@@ -55,22 +74,27 @@ func NewSession(sender util.MessageSender, config util.BaseConfig, clusterSessio
 // Initialize the session by sending the first message of the 2-AKE to the neighbor,
 // or by retrieving the QKD key.
 func (s *Session) Init() {
-	if s.config.Leader.HasRightQKDPath() {
-		rightKeyQKD := s.config.Leader.RightQKDKey()
-		s.crypto.keyRight = rightKeyQKD
+	if s.config.Leader.RightCrypto.UsesPSK() {
+		s.crypto.qkdRight = s.config.Leader.RightQKDKey()
 	}
 
-	if s.config.Leader.HasLeftQKDPath() {
-		leftKeyQKD := s.config.Leader.LeftQKDKey()
-		s.crypto.keyLeft = leftKeyQKD
+	if s.config.Leader.LeftCrypto.UsesPSK() {
+		s.crypto.qkdLeft = s.config.Leader.LeftQKDKey()
 	}
 
+	// If two leaders use QKD, one of them (this one) fetches the key
+	// and sends the key ID to his right neighbor.
+	if s.config.Leader.RightCrypto.UsesETSI() {
+		s.requestQKDKey()
+	}
+
+	s.combineLinkKeys()
 	msg := s.checkLeftRightKeys() // If we use QKD with both neighbors.
 	if !msg.IsEmpty() {
 		s.sender.Send(msg)
 	}
 
-	if !s.config.Leader.HasRightQKDUrl() && !s.config.Leader.HasRightQKDPath() {
+	if s.config.Leader.RightCrypto.UsesKyber() {
 		var akeSendARight []byte
 		akeSendARight, s.crypto.tkRight, s.crypto.eskaRight = gake.KexAkeInitA(s.config.Leader.RightPublicKey())
 
@@ -78,19 +102,164 @@ func (s *Session) Init() {
 			SenderID:   s.config.GetMemberID(),
 			SenderName: s.config.Name,
 			Type:       util.LeadAkeOneMsg,
-			ReceiverID: s.config.RightClusterID(),
+			To:         util.ToLeader(s.config.RightClusterID()),
 			Content:    base64.StdEncoding.EncodeToString(akeSendARight),
 			ClusterID:  *s.config.ClusterID,
+			Round:      s.round,
 		}
 
 		go s.sender.Send(msg)
 	}
 }
 
+// Show the fingerprints of our leader key and of the keys of the neighboring leaders,
+// so the leaders can check out of band that they use each other's keys.
+// They are shown by the message handler, so a configuration reloaded meanwhile is never shown half.
+func (s *Session) Verify() {
+	done := make(chan struct{})
+	s.verify <- done
+	<-done
+}
+
+func (s *Session) showVerification() {
+	own := gake.PublicKeyOf([gake.SkLen]byte(s.config.Leader.GetSecretKey()))
+	util.PrintLine(fmt.Sprintf("Our leader key: %s", util.KeyFingerprint(own[:])))
+
+	n := *s.config.Leader.NClusters
+	showNeighbor := func(side string, clusterID int, source *util.CryptoSource, key func() [gake.PkLen]byte) {
+		if !source.UsesKyber() {
+			util.PrintLine(fmt.Sprintf("The %s link to cluster %d uses %s, there is no public key to verify.", side, clusterID, source.Kind))
+			return
+		}
+		pk := key()
+		util.PrintLine(fmt.Sprintf("Key of the %s neighbor (cluster %d): %s", side, clusterID, util.KeyFingerprint(pk[:])))
+	}
+	showNeighbor("left", (*s.config.ClusterID-1+n)%n, s.config.Leader.LeftCrypto, s.config.Leader.LeftPublicKey)
+	showNeighbor("right", s.config.RightClusterID(), s.config.Leader.RightCrypto, s.config.Leader.RightPublicKey)
+}
+
 func (s *Session) MessageHandler() {
-	for msg := range s.receiveChan {
-		s.handleMessage(msg)
+	for {
+		select {
+		case msg, ok := <-s.receiveChan:
+			if !ok {
+				return
+			}
+			s.handleMessage(msg)
+		case update := <-s.updates:
+			s.applyConfig(update)
+		case done := <-s.verify:
+			s.showVerification()
+			close(done)
+		}
+	}
+}
+
+// Apply the reloaded configuration. It is handed over to the message handler, so the configuration
+// does not change while a message is processed. If rekey is set, a new run of the protocol is started.
+func (s *Session) Reload(config util.BaseConfig, rekey bool) {
+	s.updates <- configUpdate{config: config, rekey: rekey}
+}
+
+func (s *Session) applyConfig(update configUpdate) {
+	s.config = update.config
+
+	if s.qkdPool != nil {
+		// The KME settings may have changed, so the pool is created again for the next key.
+		s.qkdPool.Close()
+		s.qkdPool = nil
+		if !update.rekey && s.crypto.qkdRight == [gake.SsLen]byte{} {
+			s.requestQKDKey()
+		}
+	}
+
+	if update.rekey {
+		util.LogCrypto("Leader keys changed, rekeying the leaders")
+		s.rekey(util.NewRound(s.round))
+	}
+}
+
+// Start or join the run of the protocol with the given round, using the current configuration.
+// The cluster keeps using the current Main Session Key until the new one is established.
+func (s *Session) rekey(round int64) {
+	s.round, s.rekeyed = round, true
+	s.crypto = NewCryptoSession(*s.config.Leader.NClusters)
+	s.Init()
+}
+
+// Report whether our run of the protocol has received all the Xs.
+func (s *Session) finished() bool {
+	return !slices.Contains(s.crypto.xs, [gake.SsLen]byte{})
+}
+
+// Report whether the message belongs to an older run of the protocol than ours, or repeats a message of our run
+// after it has finished, for example a late duplicate or a message replayed by the mesh history.
+// The leaders start their first run at different times, so until it finishes, messages of older rounds are accepted.
+func (s *Session) isStale(recv util.Message) bool {
+	if recv.Round == 0 {
+		return false
+	}
+	if !util.PlausibleRound(recv.Round) {
+		return true
+	}
+	switch {
+	case recv.Round < s.round:
+		return s.finished() || s.rekeyed
+	case recv.Round == s.round && s.finished():
+		return true // Every message of the leader protocol belongs to the run.
+	}
+	return false
+}
+
+// Report whether the message starts a run of the protocol with a newer round than ours after our first run,
+// which means the sender is rekeying and we have to join it.
+func (s *Session) startsNewRun(recv util.Message) bool {
+	if recv.Round <= s.round || !(s.finished() || s.rekeyed) {
+		return false
+	}
+	switch recv.Type {
+	case util.LeadAkeOneMsg, util.LeaderXiRiCommitmentMsg, util.QKDIDLeaderMsg:
+		return true
 	}
+	return false
+}
+
+// Take a key of the link with the right neighbor from the KME in the background,
+// deliver it to our message handler and send its ID to the neighbor.
+func (s *Session) requestQKDKey() {
+	if s.qkdPool == nil {
+		s.qkdPool = s.config.QKDPool(util.QKDLinkRight)
+	}
+	pool, config, round := s.qkdPool, s.config, s.round
+
+	go func() {
+		ctx, cancel := config.QKD.RetryPolicy().KeyContext()
+		defer cancel()
+		key, keyID, err := pool.Take(ctx)
+		if errors.Is(err, util.ErrPoolClosed) {
+			return // The configuration was reloaded, the key is requested from the new pool.
+		}
+		if err != nil {
+			util.LogError(fmt.Sprintf("Failed to retrieve right QKD key, aborting this run of the protocol: %v", err))
+			return
+		}
+
+		s.receiveChan <- util.Message{
+			Type:  util.QKDRightKeyMsg,
+			Key:   key,
+			Round: round,
+		}
+
+		s.sender.Send(util.Message{
+			ClusterID:  *config.ClusterID,
+			SenderID:   config.GetMemberID(),
+			To:         util.ToLeader(config.RightClusterID()),
+			SenderName: config.Name,
+			Type:       util.QKDIDLeaderMsg,
+			Content:    keyID,
+			Round:      round,
+		})
+	}()
 }
 
 // Process the first message of 2-AKE, holding as a result keyLeft. The second message of 2-AKE is then sent.
@@ -103,7 +272,7 @@ func (s *Session) onAkeOne(recv util.Message) {
 	}
 
 	var akeSendB []byte
-	akeSendB, s.crypto.keyLeft = gake.KexAkeSharedB(
+	akeSendB, s.crypto.akeLeft = gake.KexAkeSharedB(
 		akeSendA,
 		s.config.Leader.GetSecretKey(),
 		s.config.Leader.LeftPublicKey())
@@ -113,12 +282,14 @@ func (s *Session) onAkeOne(recv util.Message) {
 		SenderID:   s.config.GetMemberID(),
 		SenderName: s.config.Name,
 		Type:       util.LeadAkeTwoMsg,
-		ReceiverID: recv.ClusterID,
+		To:         util.ToLeader(recv.ClusterID),
 		Content:    base64.StdEncoding.EncodeToString(akeSendB),
 		ClusterID:  *s.config.ClusterID,
+		Round:      recv.Round, // The round of the message we answer, so an answer to an earlier run is dropped.
 	}
 	s.sender.Send(msg)
 
+	s.combineLinkKeys()
 	msg = s.checkLeftRightKeys()
 	if !msg.IsEmpty() {
 		s.sender.Send(msg)
@@ -134,10 +305,11 @@ func (s *Session) onAkeTwo(recv util.Message) {
 		return
 	}
 
-	s.crypto.keyRight = gake.KexAkeSharedA(akeSendB, s.crypto.tkRight, s.crypto.eskaRight, s.config.Leader.GetSecretKey())
+	s.crypto.akeRight = gake.KexAkeSharedA(akeSendB, s.crypto.tkRight, s.crypto.eskaRight, s.config.Leader.GetSecretKey())
 
 	util.LogCrypto("Established Leader 2-AKE shared key with right neighbor")
 
+	s.combineLinkKeys()
 	msg := s.checkLeftRightKeys()
 	if !msg.IsEmpty() {
 		s.sender.Send(msg)
@@ -163,13 +335,13 @@ func (s *Session) onXiRiCommitment(recv util.Message) {
 
 // Process the key message from the ETSI server.
 func (s *Session) onLeftKey(recv util.Message) {
-	decoded, err := base64.StdEncoding.DecodeString(recv.Content)
-	if err != nil || len(decoded) < gake.SsLen {
-		util.LogError("Invalid base64 content received")
+	if len(recv.Key) != util.QKDLinkLeft.KeySize() {
+		util.LogError(fmt.Sprintf("Invalid left QKD key of %d bytes", len(recv.Key)))
 		return
 	}
-	copy(s.crypto.keyLeft[:], decoded)
+	copy(s.crypto.qkdLeft[:], recv.Key)
 
+	s.combineLinkKeys()
 	msg := s.checkLeftRightKeys()
 	if !msg.IsEmpty() {
 		s.sender.Send(msg)
@@ -178,14 +350,13 @@ func (s *Session) onLeftKey(recv util.Message) {
 
 // Process the key message from the ETSI server.
 func (s *Session) onRightKey(recv util.Message) {
-	decoded, err := base64.StdEncoding.DecodeString(recv.Content)
-	if err != nil || len(decoded) < gake.SsLen {
-		util.LogError("Invalid base64 content received")
+	if len(recv.Key) != util.QKDLinkRight.KeySize() {
+		util.LogError(fmt.Sprintf("Invalid right QKD key of %d bytes", len(recv.Key)))
 		return
 	}
+	copy(s.crypto.qkdRight[:], recv.Key)
 
-	copy(s.crypto.keyRight[:], decoded)
-
+	s.combineLinkKeys()
 	msg := s.checkLeftRightKeys()
 	if !msg.IsEmpty() {
 		s.sender.Send(msg)
@@ -193,15 +364,42 @@ func (s *Session) onRightKey(recv util.Message) {
 }
 
 // When we receive the Key ID, we fetch our copy of the key.
+// The KME may be slow or down, so the key is fetched in the background and delivered back to our message handler.
 func (s *Session) onQKDID(recv util.Message) {
-	key := util.RequestKeyByID(s.config.Leader.LeftQKDUrl(), recv.Content)
-	s.onLeftKey(util.Message{
-		Content: key,
-	})
+	client, policy, round := s.config.QKDClient(util.QKDLinkLeft), s.config.QKD.RetryPolicy(), s.round
+	go func() {
+		ctx, cancel := policy.KeyContext()
+		defer cancel()
+		key, err := util.RequestKeyByID(ctx, client, recv.Content)
+		if err != nil {
+			util.LogError(fmt.Sprintf("Failed to retrieve left QKD key, aborting this run of the protocol: %v", err))
+			return
+		}
+		s.receiveChan <- util.Message{
+			Type:  util.QKDLeftKeyMsg,
+			Key:   key,
+			Round: round,
+		}
+	}()
 }
 
 // Handle the received message according to its type.
+// The key material of the message is erased once it is handled, even if the message is dropped.
 func (s *Session) handleMessage(recv util.Message) {
+	defer clear(recv.Key)
+	if s.isStale(recv) {
+		util.LogCrypto(fmt.Sprintf("Dropping %s of an earlier run from %s", recv.TypeName(), recv.SenderName))
+		return
+	}
+	switch {
+	case s.startsNewRun(recv):
+		util.LogCrypto(fmt.Sprintf("%s is rekeying the leaders, joining", recv.SenderName))
+		s.rekey(recv.Round)
+	case recv.Round > s.round && !s.finished() && !s.rekeyed:
+		// The leaders starting after us have newer rounds, our first run ends with the newest one.
+		s.round = recv.Round
+	}
+
 	switch recv.Type {
 	case util.LeadAkeOneMsg:
 		s.onAkeOne(recv)
@@ -220,6 +418,39 @@ func (s *Session) handleMessage(recv util.Message) {
 	}
 }
 
+// Derive keyLeft and keyRight once all the keys required for the link are available.
+// A link uses the 2-AKE key, the QKD key, or in hybrid mode both of them combined through a KDF.
+func (s *Session) combineLinkKeys() {
+	leader := s.config.Leader
+	if s.crypto.keyLeft == [gake.SsLen]byte{} {
+		s.crypto.keyLeft = linkKey(s.crypto.akeLeft, s.crypto.qkdLeft, leader.LeftCrypto.UsesKyber(), leader.LeftCrypto.UsesQKD())
+		if s.crypto.keyLeft != [gake.SsLen]byte{} && leader.LeftCrypto.UsesKyber() && leader.LeftCrypto.UsesQKD() {
+			util.LogCrypto("Combined 2-AKE and QKD keys with left neighbor")
+		}
+	}
+	if s.crypto.keyRight == [gake.SsLen]byte{} {
+		s.crypto.keyRight = linkKey(s.crypto.akeRight, s.crypto.qkdRight, leader.RightCrypto.UsesKyber(), leader.RightCrypto.UsesQKD())
+		if s.crypto.keyRight != [gake.SsLen]byte{} && leader.RightCrypto.UsesKyber() && leader.RightCrypto.UsesQKD() {
+			util.LogCrypto("Combined 2-AKE and QKD keys with right neighbor")
+		}
+	}
+}
+
+// Get the key of the link, or the zero key if some of the required keys are still missing.
+func linkKey(akeKey, qkdKey [gake.SsLen]byte, usesKyber, usesQKD bool) [gake.SsLen]byte {
+	if (usesKyber && akeKey == [gake.SsLen]byte{}) || (usesQKD && qkdKey == [gake.SsLen]byte{}) {
+		return [gake.SsLen]byte{}
+	}
+	switch {
+	case usesKyber && usesQKD:
+		return util.CombineLinkKeys(akeKey, qkdKey)
+	case usesQKD:
+		return qkdKey
+	default:
+		return akeKey
+	}
+}
+
 // Check whether we have both keyLeft and keyRight available. If so, compute the Xi, Ri and Commitment message and return it.
 // Also, try finalizing the protocol now, since the Xi we computed could have been the last one we needed.
 func (s *Session) checkLeftRightKeys() util.Message {
@@ -256,6 +487,8 @@ func (s *Session) getXiRiCommitmentMsg() util.Message {
 		Type:       util.LeaderXiRiCommitmentMsg,
 		Content:    base64.StdEncoding.EncodeToString(content),
 		ClusterID:  *s.config.ClusterID,
+		To:         util.ToLeaders(),
+		Round:      s.round,
 	}
 
 	return msg
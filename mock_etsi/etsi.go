@@ -1,111 +1,82 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
-	"encoding/hex"
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"log"
 	"net/http"
-	"pqgch/util"
-	"strconv"
-	"strings"
+	"os"
+	"pqgch/mock_etsi/kme"
+	"time"
 )
 
-// Map of Key_ID -> Key
-var keyStore = map[string]string{}
-
 func main() {
-	http.HandleFunc("/etsi/", keysHandler)
-	log.Println("Mock ETSI QKD API running on :8080")
-	http.ListenAndServe(":8080", nil)
-}
-
-func keysHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.Method, r.URL)
-
-	path := strings.TrimPrefix(r.URL.Path, "/etsi/")
-	parts := strings.Split(path, "/")
-	if len(parts) < 2 {
-		http.Error(w, "invalid URL", http.StatusBadRequest)
-		return
-	}
-
-	saeID := parts[0] // Ignore for mock server.
-	action := parts[1]
+	config := kme.DefaultConfig
+	address := flag.String("addr", ":8080", "address to listen on")
+	certFile := flag.String("cert", "", "PEM file with the server certificate, enables HTTPS")
+	keyFile := flag.String("key", "", "PEM file with the private key of the server certificate")
+	clientCA := flag.String("client-ca", "", "PEM file with the CA certificates of the SAEs, requires client certificates")
+	flag.StringVar(&config.KMEID, "kme-id", config.KMEID, "ID of this KME")
+	flag.StringVar(&config.TargetKMEID, "target-kme-id", config.TargetKMEID, "ID of the KME of the slave SAEs")
+	flag.IntVar(&config.KeySize, "key-size", config.KeySize, "default key size in bits")
+	flag.IntVar(&config.MinKeySize, "min-key-size", config.MinKeySize, "minimal key size in bits")
+	flag.IntVar(&config.MaxKeySize, "max-key-size", config.MaxKeySize, "maximal key size in bits")
+	flag.IntVar(&config.MaxKeyCount, "max-keys", config.MaxKeyCount, "maximal number of undelivered keys per key stream")
+	flag.IntVar(&config.MaxKeyPerRequest, "max-keys-per-request", config.MaxKeyPerRequest, "maximal number of keys in one request")
+	flag.IntVar(&config.MaxSAEIDCount, "max-sae-ids", config.MaxSAEIDCount, "maximal number of additional slave SAE IDs")
+	flag.BoolVar(&config.RequireAuth, "require-auth", false, "refuse SAEs without the X-SAE-ID header or a client certificate")
+	flag.StringVar(&config.StorePath, "store", "", "file the undelivered keys are saved to, so they survive a restart")
+	flag.DurationVar(&config.KeyTTL, "key-ttl", time.Hour, "time after which undelivered keys expire, 0 keeps them until delivered")
+	adminAddress := flag.String("admin", "", "address of the admin endpoint for changing the injected faults, disabled if empty")
+	flag.IntVar(&config.Faults.LatencyMs, "latency", 0, "fault: delay of every response in milliseconds")
+	flag.Float64Var(&config.Faults.ErrorRate, "error-rate", 0, "fault: fraction of requests answered with an error")
+	flag.IntVar(&config.Faults.ErrorCode, "error-code", http.StatusServiceUnavailable, "fault: status code of the injected errors")
+	flag.Float64Var(&config.Faults.DropRate, "drop-rate", 0, "fault: fraction of connections closed without a response")
+	flag.BoolVar(&config.Faults.WrongKeySize, "wrong-key-size", false, "fault: issue keys of half the requested size")
+	flag.BoolVar(&config.Faults.MismatchKeys, "mismatch-keys", false, "fault: deliver different keys to the slave SAEs")
+	flag.BoolVar(&config.Faults.Exhausted, "exhausted", false, "fault: report an empty key store and refuse to issue keys")
+	flag.Parse()
 
-	// We only allow GET requests for simplicity.
-	// This should be enough for our use case anyway.
-	if r.Method == http.MethodGet {
-		switch action {
-		case "enc_keys":
-			handleEncKeys(w, r, saeID)
-		case "dec_keys":
-			handleDecKeys(w, r, saeID)
-		default:
-			http.Error(w, "unknown endpoint", http.StatusNotFound)
-		}
-	} else {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-	}
-}
-
-func handleEncKeys(w http.ResponseWriter, r *http.Request, _ string) {
-	num, err := strconv.Atoi(r.URL.Query().Get("number"))
+	config.Logger = log.Default()
+	simulator, err := kme.Open(config)
 	if err != nil {
-		http.Error(w, "malformed input", http.StatusBadRequest)
-		return
+		log.Fatal(err)
 	}
-
-	size, err := strconv.Atoi(r.URL.Query().Get("size"))
-	if err != nil {
-		http.Error(w, "malformed input", http.StatusBadRequest)
-		return
+	if err := simulator.SetFaults(config.Faults); err != nil {
+		log.Fatalf("invalid faults: %v", err)
 	}
-
-	// Generate the key/keys and send them to the client.
-	keys := getKeys(num, size)
-	respond(w, keys)
-}
-
-func handleDecKeys(w http.ResponseWriter, r *http.Request, _ string) {
-	keyID := r.URL.Query().Get("key_ID")
-	// Look the key up in the key store.
-	if key, found := keyStore[keyID]; found {
-		respond(w, []util.Key{{KeyID: keyID, Key: key}})
-		return
+	server := &http.Server{
+		Addr:    *address,
+		Handler: simulator.Handler(),
 	}
-	http.Error(w, "key corresponding to this key_ID not found", http.StatusBadRequest)
-}
 
-func uniqueID() string {
-	bytes := make([]byte, 16)
-	_, err := rand.Read(bytes)
-	if err != nil {
-		panic(err)
+	if *adminAddress != "" {
+		go func() {
+			log.Printf("Admin endpoint running on %s", *adminAddress)
+			log.Fatal(http.ListenAndServe(*adminAddress, simulator.AdminHandler()))
+		}()
 	}
-	return hex.EncodeToString(bytes)
-}
 
-func getKeys(n, size int) []util.Key {
-	var keys []util.Key
-	// Generate n keys (should be just 1).
-	for range n {
-		id := uniqueID()
-		key := make([]byte, size/8)
-		rand.Read(key)
-		encoded := base64.StdEncoding.EncodeToString(key)
-		keyStore[id] = encoded
-		keys = append(keys, util.Key{
-			KeyID: id,
-			Key:   encoded,
-		})
+	if *certFile == "" {
+		log.Printf("Mock ETSI QKD API running on %s", *address)
+		log.Fatal(server.ListenAndServe())
 	}
 
-	return keys
-}
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if *clientCA != "" {
+		pem, err := os.ReadFile(*clientCA)
+		if err != nil {
+			log.Fatalf("cannot read client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("no PEM certificates found in %q", *clientCA)
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
 
-func respond(w http.ResponseWriter, keys []util.Key) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(util.KeyContainer{Keys: keys})
+	log.Printf("Mock ETSI QKD API running on %s (HTTPS)", *address)
+	log.Fatal(server.ListenAndServeTLS(*certFile, *keyFile))
 }
@@ -0,0 +1,105 @@
+package kme
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// Faults make the KME misbehave, to test how the SAEs cope with it. The zero value disables all of them.
+type Faults struct {
+	LatencyMs    int     `json:"latencyMs"`    // Delay before every response.
+	ErrorRate    float64 `json:"errorRate"`    // Fraction of requests answered with ErrorCode.
+	ErrorCode    int     `json:"errorCode"`    // Status code of the injected errors, 503 if not set.
+	DropRate     float64 `json:"dropRate"`     // Fraction of connections closed without any response.
+	WrongKeySize bool    `json:"wrongKeySize"` // Issue keys of half the requested size.
+	MismatchKeys bool    `json:"mismatchKeys"` // Deliver different key contents to the slave SAEs than to the master SAE.
+	Exhausted    bool    `json:"exhausted"`    // Report an empty key store and refuse to issue keys.
+}
+
+func (f Faults) validate() error {
+	switch {
+	case f.LatencyMs < 0:
+		return fmt.Errorf("latencyMs must be >= 0")
+	case f.ErrorRate < 0 || f.ErrorRate > 1 || f.DropRate < 0 || f.DropRate > 1:
+		return fmt.Errorf("errorRate and dropRate must be between 0 and 1")
+	case f.ErrorCode != 0 && (f.ErrorCode < 400 || f.ErrorCode > 599):
+		return fmt.Errorf("errorCode must be an HTTP error status code")
+	}
+	return nil
+}
+
+// Get the faults currently injected.
+func (k *KME) Faults() Faults {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.config.Faults
+}
+
+// Replace the faults injected from now on.
+func (k *KME) SetFaults(faults Faults) error {
+	if err := faults.validate(); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.config.Faults = faults
+	return nil
+}
+
+// Inject the faults affecting the whole request. Returns true if the request was answered.
+func (k *KME) injectFaults(w http.ResponseWriter, r *http.Request) bool {
+	faults := k.Faults()
+
+	if faults.LatencyMs > 0 {
+		select {
+		case <-time.After(time.Duration(faults.LatencyMs) * time.Millisecond):
+		case <-r.Context().Done():
+			return true
+		}
+	}
+	if rand.Float64() < faults.DropRate {
+		// Closes the connection without writing a response.
+		panic(http.ErrAbortHandler)
+	}
+	if rand.Float64() < faults.ErrorRate {
+		code := faults.ErrorCode
+		if code == 0 {
+			code = http.StatusServiceUnavailable
+		}
+		respondError(w, code, "injected fault")
+		return true
+	}
+	return false
+}
+
+// AdminHandler serves the injected faults on /faults. GET returns them as JSON and PUT replaces them.
+// It should be served on a different address than the ETSI API, so the SAEs cannot reach it.
+func (k *KME) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/faults", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			respond(w, k.Faults())
+		case http.MethodPut, http.MethodPost:
+			var faults Faults
+			if err := json.NewDecoder(r.Body).Decode(&faults); err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Sprintf("malformed faults: %v", err))
+				return
+			}
+			if err := k.SetFaults(faults); err != nil {
+				respondError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if k.config.Logger != nil {
+				k.config.Logger.Printf("Injecting faults: %+v", faults)
+			}
+			respond(w, faults)
+		default:
+			respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+	return mux
+}
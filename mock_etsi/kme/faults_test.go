@@ -0,0 +1,146 @@
+package kme
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"pqgch/util"
+	"testing"
+	"time"
+)
+
+func TestFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		faults Faults
+		check  func(t *testing.T, server *httptest.Server)
+	}{
+		{
+			name:   "exhausted",
+			faults: Faults{Exhausted: true},
+			check: func(t *testing.T, server *httptest.Server) {
+				var status util.KeyStatus
+				request(t, server, "SAE_A", http.MethodGet, "/etsi/SAE_B/status", nil, &status)
+				if status.StoredKeyCount != 0 {
+					t.Errorf("stored_key_count = %d, want 0", status.StoredKeyCount)
+				}
+				if code := request(t, server, "SAE_A", http.MethodGet, "/etsi/SAE_B/enc_keys", nil, nil); code != http.StatusServiceUnavailable {
+					t.Errorf("enc_keys = %d, want 503", code)
+				}
+			},
+		},
+		{
+			name:   "injected errors",
+			faults: Faults{ErrorRate: 1, ErrorCode: http.StatusInternalServerError},
+			check: func(t *testing.T, server *httptest.Server) {
+				if code := request(t, server, "SAE_A", http.MethodGet, "/etsi/SAE_B/status", nil, nil); code != http.StatusInternalServerError {
+					t.Errorf("status = %d, want 500", code)
+				}
+			},
+		},
+		{
+			name:   "injected errors default to 503",
+			faults: Faults{ErrorRate: 1},
+			check: func(t *testing.T, server *httptest.Server) {
+				if code := request(t, server, "SAE_A", http.MethodGet, "/etsi/SAE_B/status", nil, nil); code != http.StatusServiceUnavailable {
+					t.Errorf("status = %d, want 503", code)
+				}
+			},
+		},
+		{
+			name:   "dropped connections",
+			faults: Faults{DropRate: 1},
+			check: func(t *testing.T, server *httptest.Server) {
+				resp, err := server.Client().Get(server.URL + "/etsi/SAE_B/status")
+				if err == nil {
+					resp.Body.Close()
+					t.Errorf("got a response %d, want the connection to be dropped", resp.StatusCode)
+				}
+			},
+		},
+		{
+			name:   "latency",
+			faults: Faults{LatencyMs: 50},
+			check: func(t *testing.T, server *httptest.Server) {
+				start := time.Now()
+				request(t, server, "SAE_A", http.MethodGet, "/etsi/SAE_B/status", nil, nil)
+				if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+					t.Errorf("responded after %s, want at least 50ms", elapsed)
+				}
+			},
+		},
+		{
+			name:   "wrong key size",
+			faults: Faults{WrongKeySize: true},
+			check: func(t *testing.T, server *httptest.Server) {
+				key := issueKey(t, server, "/etsi/SAE_B/enc_keys?size=256")
+				material, _ := base64.StdEncoding.DecodeString(key.Key)
+				if len(material) != 16 {
+					t.Errorf("key of %d bytes, want 16", len(material))
+				}
+				if _, err := util.DecodeQKDKey(key.Key, 32); err == nil {
+					t.Error("DecodeQKDKey() accepted a key of the wrong size")
+				}
+			},
+		},
+		{
+			name:   "mismatched keys",
+			faults: Faults{MismatchKeys: true},
+			check: func(t *testing.T, server *httptest.Server) {
+				key := issueKey(t, server, "/etsi/SAE_B/enc_keys")
+				var container util.KeyContainer
+				request(t, server, "SAE_B", http.MethodGet, "/etsi/SAE_A/dec_keys?key_ID="+key.KeyID, nil, &container)
+				if len(container.Keys) != 1 || container.Keys[0].KeyID != key.KeyID {
+					t.Fatalf("dec_keys = %+v, want key %s", container.Keys, key.KeyID)
+				}
+				if container.Keys[0].Key == key.Key || len(container.Keys[0].Key) != len(key.Key) {
+					t.Errorf("slave got %q, want a different key of the same size as %q", container.Keys[0].Key, key.Key)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig
+			config.Faults = tt.faults
+			_, server := newTestServer(t, config)
+			tt.check(t, server)
+		})
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	k, server := newTestServer(t, DefaultConfig)
+	admin := httptest.NewServer(k.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	var faults Faults
+	if code := request(t, admin, "", http.MethodPut, "/faults", Faults{Exhausted: true}, &faults); code != http.StatusOK {
+		t.Fatalf("PUT /faults = %d, want 200", code)
+	}
+	if !faults.Exhausted || !k.Faults().Exhausted {
+		t.Errorf("faults = %+v, want exhausted", k.Faults())
+	}
+	if code := request(t, server, "SAE_A", http.MethodGet, "/etsi/SAE_B/enc_keys", nil, nil); code != http.StatusServiceUnavailable {
+		t.Errorf("enc_keys after injecting exhaustion = %d, want 503", code)
+	}
+
+	invalid := []Faults{{LatencyMs: -1}, {ErrorRate: 2}, {DropRate: -0.5}, {ErrorCode: 200}}
+	for _, f := range invalid {
+		if code := request(t, admin, "", http.MethodPut, "/faults", f, nil); code != http.StatusBadRequest {
+			t.Errorf("PUT /faults %+v = %d, want 400", f, code)
+		}
+	}
+	if !k.Faults().Exhausted {
+		t.Error("invalid faults replaced the injected ones")
+	}
+
+	request(t, admin, "", http.MethodGet, "/faults", nil, &faults)
+	if !faults.Exhausted {
+		t.Errorf("GET /faults = %+v, want exhausted", faults)
+	}
+	if code := request(t, admin, "", http.MethodDelete, "/faults", nil, nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE /faults = %d, want 405", code)
+	}
+}
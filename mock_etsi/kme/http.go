@@ -0,0 +1,186 @@
+package kme
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"pqgch/util"
+	"strconv"
+	"strings"
+)
+
+// URL prefixes the key streams are served under. The first is used by the pqgch examples,
+// the second is the one defined by ETSI GS QKD 014.
+var prefixes = []string{"/etsi/", "/api/v1/keys/"}
+
+// Handler serves the ETSI API under /etsi/{SAE_ID}/ and /api/v1/keys/{SAE_ID}/.
+// In tests it can be served with httptest.NewServer, or httptest.NewTLSServer for HTTPS.
+func (k *KME) Handler() http.Handler {
+	return http.HandlerFunc(k.serveHTTP)
+}
+
+func (k *KME) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if k.config.Logger != nil {
+		k.config.Logger.Println(r.Method, r.URL)
+	}
+	if k.injectFaults(w, r) {
+		return
+	}
+
+	var path string
+	for _, prefix := range prefixes {
+		if rest, found := strings.CutPrefix(r.URL.Path, prefix); found {
+			path = rest
+			break
+		}
+	}
+	saeID, action, found := strings.Cut(path, "/")
+	if !found || saeID == "" {
+		respondError(w, http.StatusNotFound, "unknown endpoint")
+		return
+	}
+
+	caller, err := k.callerID(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	switch action {
+	case "status":
+		if r.Method != http.MethodGet {
+			respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		respond(w, k.status(caller, saeID))
+	case "enc_keys":
+		k.handleEncKeys(w, r, caller, saeID)
+	case "dec_keys":
+		k.handleDecKeys(w, r, caller, saeID)
+	default:
+		respondError(w, http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+// Identify the calling SAE by the X-SAE-ID header or by the common name of its client certificate.
+// If both are present, they have to match. Unidentified SAEs have an empty ID.
+func (k *KME) callerID(r *http.Request) (string, error) {
+	id := r.Header.Get("X-SAE-ID")
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cn := r.TLS.PeerCertificates[0].Subject.CommonName
+		if id != "" && id != cn {
+			return "", fmt.Errorf("SAE ID %q does not match the client certificate %q", id, cn)
+		}
+		id = cn
+	}
+	if id == "" && k.config.RequireAuth {
+		return "", errors.New("the SAE has to identify itself")
+	}
+	return id, nil
+}
+
+// Get new keys for the slave SAE. Additional slave SAEs can only be requested using POST.
+func (k *KME) handleEncKeys(w http.ResponseWriter, r *http.Request, master, slave string) {
+	var req util.KeyRequest
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		if req.Number, err = queryInt(r, "number"); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Size, err = queryInt(r, "size"); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("malformed request: %v", err))
+			return
+		}
+		if len(req.ExtensionMandatory) > 0 {
+			respondError(w, http.StatusBadRequest, "mandatory extensions are not supported")
+			return
+		}
+	default:
+		respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	slaves := append([]string{slave}, req.AdditionalSlaveSAEIDs...)
+	keys, err := k.issue(master, slaves, req.Number, req.Size)
+	if err != nil {
+		respondErr(w, err)
+		return
+	}
+	respond(w, util.KeyContainer{Keys: keys})
+}
+
+// Get the keys issued by the master SAE with the given IDs.
+func (k *KME) handleDecKeys(w http.ResponseWriter, r *http.Request, slave, master string) {
+	var ids []string
+	switch r.Method {
+	case http.MethodGet:
+		if id := r.URL.Query().Get("key_ID"); id != "" {
+			ids = []string{id}
+		}
+	case http.MethodPost:
+		var req util.KeyIDs
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("malformed request: %v", err))
+			return
+		}
+		for _, id := range req.KeyIDs {
+			ids = append(ids, id.KeyID)
+		}
+	default:
+		respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	keys, err := k.deliver(master, slave, ids)
+	if err != nil {
+		respondErr(w, err)
+		return
+	}
+	respond(w, util.KeyContainer{Keys: keys})
+}
+
+// Parse the optional integer query parameter, 0 if it is missing.
+func queryInt(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("malformed %s: %q", name, value)
+	}
+	return n, nil
+}
+
+func respond(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// Respond with the HTTP status code corresponding to the error.
+func respondErr(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUnauthorized):
+		respondError(w, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, errUnavailable):
+		respondError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		respondError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+func respondError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+	}{message})
+}
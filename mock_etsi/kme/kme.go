@@ -0,0 +1,274 @@
+// Package kme simulates a key management entity (KME) serving the ETSI GS QKD 014 API.
+// It can be run as the mock server or used from Go tests through Handler.
+package kme
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"pqgch/util"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Limits and identity of the simulated KME, reported on the status endpoint.
+type Config struct {
+	KMEID            string // ID of this KME.
+	TargetKMEID      string // ID of the KME of the slave SAEs.
+	KeySize          int    // Default key size in bits.
+	MinKeySize       int    // Minimal key size in bits.
+	MaxKeySize       int    // Maximal key size in bits.
+	MaxKeyCount      int    // Maximal number of undelivered keys per key stream.
+	MaxKeyPerRequest int    // Maximal number of keys in one request.
+	MaxSAEIDCount    int    // Maximal number of additional slave SAE IDs.
+	// Refuse requests from SAEs that do not identify themselves with the X-SAE-ID header or a client certificate.
+	// Otherwise the key of an unidentified SAE can be retrieved any number of times by any unidentified SAE.
+	RequireAuth bool
+	Logger      *log.Logger // Logs every request when set.
+	Faults      Faults      // Faults injected from the start, they can be changed through the admin endpoint.
+	// File the undelivered keys are saved to, so they survive a restart. Keys are kept only in memory if empty.
+	// Use Open to restore the keys saved by a previous run.
+	StorePath string
+	KeyTTL    time.Duration // Undelivered keys are removed after this time, 0 keeps them until they are delivered.
+}
+
+var DefaultConfig = Config{
+	KMEID:            "MOCK_KME",
+	TargetKMEID:      "MOCK_KME",
+	KeySize:          256,
+	MinKeySize:       64,
+	MaxKeySize:       1024,
+	MaxKeyCount:      1000,
+	MaxKeyPerRequest: 128,
+	MaxSAEIDCount:    16,
+}
+
+// Errors returned to the SAEs. They are mapped to the HTTP status codes of the ETSI API.
+var (
+	errBadRequest   = errors.New("bad request")
+	errUnauthorized = errors.New("unauthorized")
+	errUnavailable  = errors.New("service unavailable")
+)
+
+// Key waiting to be delivered to the slave SAEs.
+type storedKey struct {
+	key     string
+	master  string
+	pending []string  // Slave SAEs which have not retrieved the key yet.
+	expires time.Time // Zero if the key does not expire.
+}
+
+// Key stream between the master SAE and the slave SAE.
+type stream struct {
+	master string
+	slave  string
+}
+
+// KME keeps the keys issued to master SAEs until every slave SAE retrieved them.
+// Every key is delivered only once to every SAE it was issued for. It is safe for concurrent use.
+type KME struct {
+	config Config
+
+	mu          sync.Mutex
+	keys        map[string]*storedKey // Key ID -> key.
+	outstanding map[stream]int        // Number of undelivered keys in every key stream.
+}
+
+// Create the KME keeping the keys in memory. If StorePath is set, the keys are also saved to it.
+func New(config Config) *KME {
+	return &KME{
+		config:      config,
+		keys:        make(map[string]*storedKey),
+		outstanding: make(map[stream]int),
+	}
+}
+
+// Status of the key stream from the master SAE to the slave SAE.
+func (k *KME) status(master, slave string) util.KeyStatus {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.expire()
+
+	stored := k.config.MaxKeyCount - k.outstanding[stream{master, slave}]
+	if k.config.Faults.Exhausted {
+		stored = 0
+	}
+
+	return util.KeyStatus{
+		SourceKMEID:      k.config.KMEID,
+		TargetKMEID:      k.config.TargetKMEID,
+		MasterSAEID:      master,
+		SlaveSAEID:       slave,
+		KeySize:          k.config.KeySize,
+		StoredKeyCount:   stored,
+		MaxKeyCount:      k.config.MaxKeyCount,
+		MaxKeyPerRequest: k.config.MaxKeyPerRequest,
+		MaxKeySize:       k.config.MaxKeySize,
+		MinKeySize:       k.config.MinKeySize,
+		MaxSAEIDCount:    k.config.MaxSAEIDCount,
+	}
+}
+
+// Issue new keys to the master SAE. The keys can then be retrieved by the slave SAEs using their IDs.
+func (k *KME) issue(master string, slaves []string, number, size int) ([]util.Key, error) {
+	if number == 0 {
+		number = 1
+	}
+	if size == 0 {
+		size = k.config.KeySize
+	}
+
+	switch {
+	case number < 0 || number > k.config.MaxKeyPerRequest:
+		return nil, fmt.Errorf("%w: number must be between 1 and %d", errBadRequest, k.config.MaxKeyPerRequest)
+	case size%8 != 0 || size < k.config.MinKeySize || size > k.config.MaxKeySize:
+		return nil, fmt.Errorf("%w: size must be a multiple of 8 between %d and %d", errBadRequest, k.config.MinKeySize, k.config.MaxKeySize)
+	case len(slaves)-1 > k.config.MaxSAEIDCount:
+		return nil, fmt.Errorf("%w: at most %d additional slave SAE IDs are allowed", errBadRequest, k.config.MaxSAEIDCount)
+	case slices.Contains(slaves, ""):
+		return nil, fmt.Errorf("%w: slave SAE IDs must not be empty", errBadRequest)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.expire()
+
+	if k.config.Faults.Exhausted {
+		return nil, fmt.Errorf("%w: key store exhausted", errUnavailable)
+	}
+	if k.config.Faults.WrongKeySize {
+		size /= 2
+	}
+	for _, slave := range slaves {
+		if k.outstanding[stream{master, slave}]+number > k.config.MaxKeyCount {
+			return nil, fmt.Errorf("%w: not enough keys stored for slave SAE %s", errUnavailable, slave)
+		}
+	}
+
+	var expires time.Time
+	if k.config.KeyTTL > 0 {
+		expires = time.Now().Add(k.config.KeyTTL)
+	}
+
+	keys := make([]util.Key, 0, number)
+	for range number {
+		material := make([]byte, size/8)
+		rand.Read(material)
+		id := newKeyID()
+		stored := &storedKey{
+			key:     base64.StdEncoding.EncodeToString(material),
+			master:  master,
+			pending: slices.Clone(slaves),
+			expires: expires,
+		}
+		k.add(id, stored)
+		keys = append(keys, util.Key{KeyID: id, Key: stored.key})
+	}
+
+	if err := k.save(); err != nil {
+		for _, key := range keys {
+			k.remove(key.KeyID)
+		}
+		return nil, fmt.Errorf("%w: %v", errUnavailable, err)
+	}
+	return keys, nil
+}
+
+// Deliver the keys with the given IDs to the slave SAE. All keys have to be issued by the master SAE for the slave.
+// A key is removed from the KME once every slave SAE retrieved it.
+func (k *KME) deliver(master, slave string, ids []string) ([]util.Key, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: no key IDs given", errBadRequest)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.expire()
+
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			return nil, fmt.Errorf("%w: key %s requested twice", errBadRequest, id)
+		}
+		seen[id] = true
+		stored, found := k.keys[id]
+		if !found || (stored.master != "" && stored.master != master) || (slave != "" && !slices.Contains(stored.pending, slave)) {
+			return nil, fmt.Errorf("%w: key %s is not available to SAE %q", errBadRequest, id, slave)
+		}
+	}
+
+	previous := make(map[string]storedKey)
+	keys := make([]util.Key, 0, len(ids))
+	for _, id := range ids {
+		stored := k.keys[id]
+		previous[id] = *stored
+		if k.config.Faults.MismatchKeys {
+			keys = append(keys, util.Key{KeyID: id, Key: mismatchedKey(stored.key)})
+		} else {
+			keys = append(keys, util.Key{KeyID: id, Key: stored.key})
+		}
+
+		// Keys retrieved by unidentified SAEs cannot be tracked per slave, so they stay available.
+		if slave == "" {
+			continue
+		}
+		k.remove(id)
+		pending := slices.DeleteFunc(slices.Clone(stored.pending), func(s string) bool { return s == slave })
+		if len(pending) > 0 {
+			k.add(id, &storedKey{key: stored.key, master: stored.master, pending: pending, expires: stored.expires})
+		}
+	}
+
+	if err := k.save(); err != nil {
+		for id, stored := range previous {
+			k.remove(id)
+			k.add(id, &stored)
+		}
+		return nil, fmt.Errorf("%w: %v", errUnavailable, err)
+	}
+	return keys, nil
+}
+
+// Store the key and count it in the key streams of its slave SAEs.
+// Keys of unidentified SAEs are not removed on delivery, so they do not count towards the limit.
+func (k *KME) add(id string, stored *storedKey) {
+	k.keys[id] = stored
+	if stored.master != "" {
+		for _, slave := range stored.pending {
+			k.outstanding[stream{stored.master, slave}]++
+		}
+	}
+}
+
+func (k *KME) remove(id string) {
+	stored, found := k.keys[id]
+	if !found {
+		return
+	}
+	delete(k.keys, id)
+	if stored.master != "" {
+		for _, slave := range stored.pending {
+			k.outstanding[stream{stored.master, slave}]--
+		}
+	}
+}
+
+// Generate a random key of the same size as the given one.
+func mismatchedKey(key string) string {
+	material := make([]byte, base64.StdEncoding.DecodedLen(len(key)))
+	n, _ := base64.StdEncoding.Decode(material, []byte(key))
+	rand.Read(material[:n])
+	return base64.StdEncoding.EncodeToString(material[:n])
+}
+
+// Generate a random key ID in the UUID format used by the ETSI API.
+func newKeyID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
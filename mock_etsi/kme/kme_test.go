@@ -0,0 +1,220 @@
+package kme
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"pqgch/util"
+	"testing"
+)
+
+// Send the request as the SAE with the given ID, or as an unidentified SAE if it is empty,
+// and decode the JSON response into out unless it is nil. Returns the status code.
+func request(t *testing.T, server *httptest.Server, sae, method, path string, body, out any) int {
+	t.Helper()
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, server.URL+path, &reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sae != "" {
+		req.Header.Set("X-SAE-ID", sae)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: invalid response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func sameKey(a, b util.Key) bool {
+	return a.KeyID == b.KeyID && a.Key == b.Key
+}
+
+func newTestServer(t *testing.T, config Config) (*KME, *httptest.Server) {
+	t.Helper()
+	k := New(config)
+	server := httptest.NewServer(k.Handler())
+	t.Cleanup(server.Close)
+	return k, server
+}
+
+// Issue a single key from SAE_A to SAE_B and return it.
+func issueKey(t *testing.T, server *httptest.Server, path string) util.Key {
+	t.Helper()
+	var container util.KeyContainer
+	if code := request(t, server, "SAE_A", http.MethodGet, path, nil, &container); code != http.StatusOK {
+		t.Fatalf("GET %s = %d, want 200", path, code)
+	}
+	if len(container.Keys) != 1 {
+		t.Fatalf("GET %s returned %d keys, want 1", path, len(container.Keys))
+	}
+	return container.Keys[0]
+}
+
+func TestIssueAndDeliverOnce(t *testing.T) {
+	for _, prefix := range prefixes {
+		t.Run(prefix, func(t *testing.T) {
+			_, server := newTestServer(t, DefaultConfig)
+			key := issueKey(t, server, prefix+"SAE_B/enc_keys")
+			decPath := prefix + "SAE_A/dec_keys?key_ID=" + key.KeyID
+
+			if code := request(t, server, "SAE_C", http.MethodGet, decPath, nil, nil); code != http.StatusBadRequest {
+				t.Errorf("key delivered to SAE_C it was not issued for: %d", code)
+			}
+
+			var container util.KeyContainer
+			if code := request(t, server, "SAE_B", http.MethodGet, decPath, nil, &container); code != http.StatusOK {
+				t.Fatalf("dec_keys = %d, want 200", code)
+			}
+			if len(container.Keys) != 1 || !sameKey(container.Keys[0], key) {
+				t.Errorf("dec_keys = %+v, want %+v", container.Keys, key)
+			}
+
+			if code := request(t, server, "SAE_B", http.MethodGet, decPath, nil, nil); code != http.StatusBadRequest {
+				t.Errorf("key delivered twice: %d", code)
+			}
+		})
+	}
+}
+
+func TestAdditionalSlaves(t *testing.T) {
+	_, server := newTestServer(t, DefaultConfig)
+
+	var container util.KeyContainer
+	req := util.KeyRequest{Number: 2, Size: 512, AdditionalSlaveSAEIDs: []string{"SAE_C"}}
+	if code := request(t, server, "SAE_A", http.MethodPost, "/etsi/SAE_B/enc_keys", req, &container); code != http.StatusOK {
+		t.Fatalf("POST enc_keys = %d, want 200", code)
+	}
+	if len(container.Keys) != 2 {
+		t.Fatalf("POST enc_keys returned %d keys, want 2", len(container.Keys))
+	}
+
+	ids := util.KeyIDs{KeyIDs: []util.KeyID{{KeyID: container.Keys[0].KeyID}, {KeyID: container.Keys[1].KeyID}}}
+	for _, slave := range []string{"SAE_B", "SAE_C"} {
+		var delivered util.KeyContainer
+		if code := request(t, server, slave, http.MethodPost, "/etsi/SAE_A/dec_keys", ids, &delivered); code != http.StatusOK {
+			t.Fatalf("dec_keys of %s = %d, want 200", slave, code)
+		}
+		for i, key := range delivered.Keys {
+			if !sameKey(key, container.Keys[i]) {
+				t.Errorf("%s got key %+v, want %+v", slave, key, container.Keys[i])
+			}
+		}
+	}
+}
+
+func TestStatusCountsOutstandingKeys(t *testing.T) {
+	config := DefaultConfig
+	config.MaxKeyCount = 5
+	_, server := newTestServer(t, config)
+
+	var status util.KeyStatus
+	request(t, server, "SAE_A", http.MethodGet, "/etsi/SAE_B/status", nil, &status)
+	if status.StoredKeyCount != 5 || status.MasterSAEID != "SAE_A" || status.SlaveSAEID != "SAE_B" {
+		t.Fatalf("status = %+v, want 5 keys stored from SAE_A to SAE_B", status)
+	}
+
+	key := issueKey(t, server, "/etsi/SAE_B/enc_keys")
+	request(t, server, "SAE_A", http.MethodGet, "/etsi/SAE_B/status", nil, &status)
+	if status.StoredKeyCount != 4 {
+		t.Errorf("stored_key_count = %d after issuing a key, want 4", status.StoredKeyCount)
+	}
+
+	request(t, server, "SAE_B", http.MethodGet, "/etsi/SAE_A/dec_keys?key_ID="+key.KeyID, nil, nil)
+	request(t, server, "SAE_A", http.MethodGet, "/etsi/SAE_B/status", nil, &status)
+	if status.StoredKeyCount != 5 {
+		t.Errorf("stored_key_count = %d after delivering the key, want 5", status.StoredKeyCount)
+	}
+
+	if code := request(t, server, "SAE_A", http.MethodGet, "/etsi/SAE_B/enc_keys?number=6", nil, nil); code != http.StatusServiceUnavailable {
+		t.Errorf("enc_keys of more keys than stored = %d, want 503", code)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	config := DefaultConfig
+	config.MaxKeyCount = 2
+	config.RequireAuth = true
+	_, server := newTestServer(t, config)
+
+	tests := []struct {
+		name   string
+		sae    string
+		method string
+		path   string
+		body   any
+		want   int
+	}{
+		{"unidentified SAE", "", http.MethodGet, "/etsi/SAE_B/enc_keys", nil, http.StatusUnauthorized},
+		{"unknown endpoint", "SAE_A", http.MethodGet, "/etsi/SAE_B/keys", nil, http.StatusNotFound},
+		{"missing SAE ID", "SAE_A", http.MethodGet, "/etsi//status", nil, http.StatusNotFound},
+		{"size not a multiple of 8", "SAE_A", http.MethodGet, "/etsi/SAE_B/enc_keys?size=100", nil, http.StatusBadRequest},
+		{"size over the maximum", "SAE_A", http.MethodGet, "/etsi/SAE_B/enc_keys?size=2048", nil, http.StatusBadRequest},
+		{"malformed number", "SAE_A", http.MethodGet, "/etsi/SAE_B/enc_keys?number=many", nil, http.StatusBadRequest},
+		{"more keys than allowed per request", "SAE_A", http.MethodGet, "/etsi/SAE_B/enc_keys?number=129", nil, http.StatusBadRequest},
+		{"more keys than stored", "SAE_A", http.MethodGet, "/etsi/SAE_B/enc_keys?number=3", nil, http.StatusServiceUnavailable},
+		{"empty additional slave", "SAE_A", http.MethodPost, "/etsi/SAE_B/enc_keys", util.KeyRequest{AdditionalSlaveSAEIDs: []string{""}}, http.StatusBadRequest},
+		{"no key IDs", "SAE_B", http.MethodGet, "/etsi/SAE_A/dec_keys", nil, http.StatusBadRequest},
+		{"unknown key ID", "SAE_B", http.MethodGet, "/etsi/SAE_A/dec_keys?key_ID=unknown", nil, http.StatusBadRequest},
+		{"status by POST", "SAE_A", http.MethodPost, "/etsi/SAE_B/status", nil, http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := request(t, server, tt.sae, tt.method, tt.path, tt.body, nil); code != tt.want {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, code, tt.want)
+			}
+		})
+	}
+}
+
+// Keys of unidentified SAEs cannot be tracked per slave, so they stay available, unless RequireAuth is set.
+func TestUnidentifiedSAEs(t *testing.T) {
+	_, server := newTestServer(t, DefaultConfig)
+
+	var container util.KeyContainer
+	if code := request(t, server, "", http.MethodGet, "/etsi/SAE_B/enc_keys", nil, &container); code != http.StatusOK {
+		t.Fatalf("enc_keys of an unidentified SAE = %d, want 200", code)
+	}
+	decPath := "/etsi/SAE_A/dec_keys?key_ID=" + container.Keys[0].KeyID
+	for range 2 {
+		if code := request(t, server, "", http.MethodGet, decPath, nil, nil); code != http.StatusOK {
+			t.Errorf("dec_keys of an unidentified SAE = %d, want 200", code)
+		}
+	}
+}
+
+// The ETSI client of the application retrieves the same key on both sides.
+func TestETSIClientRoundTrip(t *testing.T) {
+	_, server := newTestServer(t, DefaultConfig)
+
+	client := util.NewETSIClient(server.URL+"/api/v1/keys/SAE_B", nil)
+	keys, err := client.GetKeys(context.Background(), util.KeyRequest{Number: 1, Size: 256})
+	if err != nil {
+		t.Fatalf("GetKeys(): %v", err)
+	}
+	delivered, err := client.GetKeysWithIDs(context.Background(), util.KeyIDs{KeyIDs: []util.KeyID{{KeyID: keys[0].KeyID}}})
+	if err != nil {
+		t.Fatalf("GetKeysWithIDs(): %v", err)
+	}
+	if !sameKey(delivered[0], keys[0]) {
+		t.Errorf("GetKeysWithIDs() = %+v, want %+v", delivered[0], keys[0])
+	}
+}
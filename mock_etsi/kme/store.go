@@ -0,0 +1,116 @@
+package kme
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const storeVersion = 1
+
+// Key as saved in the store file.
+type record struct {
+	KeyID   string     `json:"keyId"`
+	Key     string     `json:"key"`
+	Master  string     `json:"master"`
+	Pending []string   `json:"pending"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type storeFile struct {
+	Version int      `json:"version"`
+	Keys    []record `json:"keys"`
+}
+
+// Open creates the KME like New and restores the undelivered keys from the store file, if it is configured.
+// A missing store file is not an error, it is created once the first key is issued.
+func Open(config Config) (*KME, error) {
+	k := New(config)
+	if config.StorePath == "" {
+		return k, nil
+	}
+
+	data, err := os.ReadFile(config.StorePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key store: %w", err)
+	}
+
+	var file storeFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid key store %q: %w", config.StorePath, err)
+	}
+	if file.Version != storeVersion {
+		return nil, fmt.Errorf("unsupported key store version %d in %q", file.Version, config.StorePath)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, r := range file.Keys {
+		stored := &storedKey{key: r.Key, master: r.Master, pending: r.Pending}
+		if r.Expires != nil {
+			stored.expires = *r.Expires
+		}
+		k.add(r.KeyID, stored)
+	}
+	k.expire()
+	return k, nil
+}
+
+// Remove the keys which expired before being delivered.
+func (k *KME) expire() {
+	now := time.Now()
+	for id, stored := range k.keys {
+		if !stored.expires.IsZero() && now.After(stored.expires) {
+			k.remove(id)
+		}
+	}
+}
+
+// Write all undelivered keys to the store file, if it is configured.
+// The file is replaced atomically, so a crash never leaves a partially written store behind.
+func (k *KME) save() error {
+	if k.config.StorePath == "" {
+		return nil
+	}
+
+	file := storeFile{Version: storeVersion, Keys: make([]record, 0, len(k.keys))}
+	for id, stored := range k.keys {
+		r := record{KeyID: id, Key: stored.key, Master: stored.master, Pending: stored.pending}
+		if !stored.expires.IsZero() {
+			r.Expires = &stored.expires
+		}
+		file.Keys = append(file.Keys, r)
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(k.config.StorePath), filepath.Base(k.config.StorePath)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("cannot save key store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot save key store: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot save key store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot save key store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), k.config.StorePath); err != nil {
+		return fmt.Errorf("cannot save key store: %w", err)
+	}
+	return nil
+}
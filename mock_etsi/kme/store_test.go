@@ -0,0 +1,105 @@
+package kme
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"pqgch/util"
+	"testing"
+	"time"
+)
+
+func openTestServer(t *testing.T, config Config) *httptest.Server {
+	t.Helper()
+	k, err := Open(config)
+	if err != nil {
+		t.Fatalf("Open(): %v", err)
+	}
+	server := httptest.NewServer(k.Handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Undelivered keys survive a restart of the KME, delivered ones do not.
+func TestStoreSurvivesRestart(t *testing.T) {
+	config := DefaultConfig
+	config.StorePath = filepath.Join(t.TempDir(), "keys.json")
+
+	server := openTestServer(t, config)
+	delivered := issueKey(t, server, "/etsi/SAE_B/enc_keys")
+	pending := issueKey(t, server, "/etsi/SAE_B/enc_keys")
+	if code := request(t, server, "SAE_B", http.MethodGet, "/etsi/SAE_A/dec_keys?key_ID="+delivered.KeyID, nil, nil); code != http.StatusOK {
+		t.Fatalf("dec_keys = %d, want 200", code)
+	}
+	server.Close()
+
+	restarted := openTestServer(t, config)
+	var container util.KeyContainer
+	if code := request(t, restarted, "SAE_B", http.MethodGet, "/etsi/SAE_A/dec_keys?key_ID="+pending.KeyID, nil, &container); code != http.StatusOK {
+		t.Fatalf("dec_keys of the pending key after the restart = %d, want 200", code)
+	}
+	if len(container.Keys) != 1 || !sameKey(container.Keys[0], pending) {
+		t.Errorf("dec_keys = %+v, want %+v", container.Keys, pending)
+	}
+	if code := request(t, restarted, "SAE_B", http.MethodGet, "/etsi/SAE_A/dec_keys?key_ID="+delivered.KeyID, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("key delivered before the restart was delivered again: %d", code)
+	}
+}
+
+func TestOpenStoreFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string // Contents of the store file, empty to leave it missing.
+		wantErr  bool
+	}{
+		{"missing file", "", false},
+		{"empty store", `{"version": 1, "keys": []}`, false},
+		{"invalid JSON", `{"version": 1, "keys": [`, true},
+		{"unsupported version", `{"version": 2, "keys": []}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig
+			config.StorePath = filepath.Join(t.TempDir(), "keys.json")
+			if tt.contents != "" {
+				if err := os.WriteFile(config.StorePath, []byte(tt.contents), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := Open(config); (err != nil) != tt.wantErr {
+				t.Errorf("Open() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Expired keys are neither delivered nor counted, and are not restored from the store file.
+func TestKeyTTL(t *testing.T) {
+	config := DefaultConfig
+	config.MaxKeyCount = 5
+	config.KeyTTL = 20 * time.Millisecond
+	config.StorePath = filepath.Join(t.TempDir(), "keys.json")
+	server := openTestServer(t, config)
+
+	key := issueKey(t, server, "/etsi/SAE_B/enc_keys")
+	time.Sleep(2 * config.KeyTTL)
+
+	var status util.KeyStatus
+	request(t, server, "SAE_A", http.MethodGet, "/etsi/SAE_B/status", nil, &status)
+	if status.StoredKeyCount != 5 {
+		t.Errorf("stored_key_count = %d after the key expired, want 5", status.StoredKeyCount)
+	}
+	if code := request(t, server, "SAE_B", http.MethodGet, "/etsi/SAE_A/dec_keys?key_ID="+key.KeyID, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("expired key delivered: %d", code)
+	}
+
+	pending := issueKey(t, server, "/etsi/SAE_B/enc_keys")
+	server.Close()
+	time.Sleep(2 * config.KeyTTL)
+	restarted := openTestServer(t, config)
+	if code := request(t, restarted, "SAE_B", http.MethodGet, "/etsi/SAE_A/dec_keys?key_ID="+pending.KeyID, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("key expired while the KME was down was delivered: %d", code)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"pqgch/gake"
+	"pqgch/util"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Config of one participant in the checked tree.
+type checkedConfig struct {
+	name   string // Path of the config relative to the checked directory.
+	config util.BaseConfig
+}
+
+// Check the configs of a whole deployment against each other and report all problems at once.
+func runCheck(args []string) error {
+	flags := newFlags("check")
+	fileName := flags.String("name", configPath, "file name of the configs in the tree")
+	asJSON := jsonFlag(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return usageError(flags, "exactly one directory is required")
+	}
+
+	configs, problems := loadTree(flags.Arg(0), *fileName)
+	problems = append(problems, checkClusters(configs)...)
+	problems = append(problems, checkRing(configs)...)
+
+	text := fmt.Sprintf("checked %d configs, no problems found\n", len(configs))
+	if len(problems) > 0 {
+		text = fmt.Sprintf("checked %d configs, found %d problems:\n- %s\n", len(configs), len(problems), strings.Join(problems, "\n- "))
+	}
+	report(*asJSON, map[string]any{"configs": len(configs), "problems": problems}, text)
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems", len(problems))
+	}
+	return nil
+}
+
+// Load every config in the tree. Each one is validated on its own, like when starting a member or leader.
+func loadTree(dir, fileName string) ([]checkedConfig, []string) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && d.Name() == fileName {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, []string{fmt.Sprintf("cannot read %s: %v", dir, err)}
+	}
+	if len(paths) == 0 {
+		return nil, []string{fmt.Sprintf("no %s found in %s", fileName, dir)}
+	}
+	sort.Strings(paths)
+
+	var configs []checkedConfig
+	var problems []string
+	for _, path := range paths {
+		name, _ := filepath.Rel(dir, path)
+		config, err := util.LoadConfigFile(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, strings.ReplaceAll(err.Error(), "\n", "\n  ")))
+			continue
+		}
+		configs = append(configs, checkedConfig{name, config})
+	}
+	return configs, problems
+}
+
+// Check that every cluster has one leader and exactly the members 0..nMembers-1,
+// and that the members agree on the keys and their sources.
+func checkClusters(configs []checkedConfig) []string {
+	var problems []string
+	fail := func(clusterID int, format string, args ...any) {
+		problems = append(problems, fmt.Sprintf("cluster %d: "+format, append([]any{clusterID}, args...)...))
+	}
+
+	clusters := map[int][]checkedConfig{}
+	for _, c := range configs {
+		clusters[*c.config.ClusterID] = append(clusters[*c.config.ClusterID], c)
+	}
+
+	for _, clusterID := range sortedKeys(clusters) {
+		var leaders, members []checkedConfig
+		for _, c := range clusters[clusterID] {
+			if c.config.Leader != nil {
+				leaders = append(leaders, c)
+			}
+			if c.config.Cluster != nil {
+				members = append(members, c)
+			}
+		}
+
+		// Missing leaders are reported by checkRing.
+		if len(leaders) > 1 {
+			fail(clusterID, "%d leaders %s", len(leaders), names(leaders))
+		}
+		if len(members) == 0 {
+			continue
+		}
+		for _, l := range leaders {
+			if l.config.Cluster == nil {
+				fail(clusterID, "%s has no cluster section, but the cluster has members", l.name)
+			}
+		}
+
+		// Sizes and member IDs.
+		first := members[0]
+		nMembers := *first.config.Cluster.NMembers
+		byID := map[int][]checkedConfig{}
+		sizesAgree := true
+		for _, m := range members {
+			if n := *m.config.Cluster.NMembers; n != nMembers {
+				fail(clusterID, "%s has nMembers %d, but %s has %d", m.name, n, first.name, nMembers)
+				sizesAgree = false
+			}
+			if id := *m.config.Cluster.MemberID; id < 0 || id >= nMembers {
+				fail(clusterID, "%s has memberID %d out of range 0..%d", m.name, id, nMembers-1)
+				continue
+			}
+			byID[*m.config.Cluster.MemberID] = append(byID[*m.config.Cluster.MemberID], m)
+		}
+		for _, id := range sortedKeys(byID) {
+			if len(byID[id]) > 1 {
+				fail(clusterID, "member ID %d is used by %s", id, names(byID[id]))
+			}
+		}
+		if sizesAgree {
+			var missing []int
+			for id := range nMembers {
+				if len(byID[id]) == 0 {
+					missing = append(missing, id)
+				}
+			}
+			if len(missing) > 0 {
+				fail(clusterID, "no config for member IDs %v of %d", missing, nMembers)
+			}
+		}
+
+		// Crypto sources.
+		kind := clusterKind(first.config.Cluster)
+		sourcesAgree := true
+		for _, m := range members[1:] {
+			if k := clusterKind(m.config.Cluster); k != kind {
+				fail(clusterID, "%s uses %s crypto, but %s uses %s", m.name, k, first.name, kind)
+				sourcesAgree = false
+			} else if m.config.Cluster.IsClusterQKDPath() != first.config.Cluster.IsClusterQKDPath() {
+				fail(clusterID, "only one of %s and %s uses a pre-shared key", m.name, first.name)
+				sourcesAgree = false
+			}
+		}
+		if !sizesAgree || !sourcesAgree {
+			continue
+		}
+
+		// Keys.
+		if first.config.Cluster.UsesKyber() {
+			pks := first.config.Cluster.GetPublicKeys()
+			for _, m := range members {
+				other := m.config.Cluster.GetPublicKeys()
+				if !slices.Equal(other, pks) {
+					fail(clusterID, "public keys of %s differ from the ones of %s", m.name, first.name)
+					continue
+				}
+				id := *m.config.Cluster.MemberID
+				if id < 0 || id >= len(pks) {
+					continue // Reported with the member IDs.
+				}
+				if gake.PublicKeyOf([gake.SkLen]byte(m.config.Cluster.GetSecretKey())) != pks[id] {
+					fail(clusterID, "secretKey of %s does not match the public key of member %d", m.name, id)
+				}
+			}
+		}
+		if first.config.Cluster.IsClusterQKDPath() {
+			psk, _ := first.config.Cluster.ClusterQKDKeyFromFile()
+			for _, m := range members[1:] {
+				if other, _ := m.config.Cluster.ClusterQKDKeyFromFile(); other != psk {
+					fail(clusterID, "pre-shared key of %s differs from the one of %s", m.name, first.name)
+				}
+			}
+		}
+		if first.config.Cluster.Crypto.UsesETSI() && len(leaders) == 1 && leaders[0].config.Cluster != nil {
+			problems = append(problems, checkClusterSAEIDs(clusterID, leaders[0], members)...)
+		}
+	}
+
+	return problems
+}
+
+// Check that the members retrieve the cluster key from the key stream of the leader,
+// and that the leader requests it for every member.
+func checkClusterSAEIDs(clusterID int, leader checkedConfig, members []checkedConfig) []string {
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf("cluster %d: "+format, append([]any{clusterID}, args...)...))
+	}
+
+	leaderOwn, leaderPeer := leader.config.QKDSAEIDs(util.QKDLinkCluster)
+	slaves := append([]string{leaderPeer}, leader.config.AdditionalSlaveSAEIDs()...)
+	for _, m := range members {
+		if m.config.Leader != nil {
+			continue
+		}
+		own, peer := m.config.QKDSAEIDs(util.QKDLinkCluster)
+		if peer != "" && leaderOwn != "" && peer != leaderOwn {
+			fail("%s retrieves cluster keys of SAE %s, but the leader %s is SAE %s", m.name, peer, leader.name, leaderOwn)
+		}
+		if own != "" && leaderPeer != "" && !slices.Contains(slaves, own) {
+			fail("%s is SAE %s, but the leader %s requests cluster keys only for %s", m.name, own, leader.name, strings.Join(slaves, ", "))
+		}
+	}
+	return problems
+}
+
+// Check that the leaders form a ring of nClusters, and that the right link of every leader
+// matches the left link of its right neighbor.
+func checkRing(configs []checkedConfig) []string {
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, "ring: "+fmt.Sprintf(format, args...))
+	}
+
+	leaders := map[int]checkedConfig{}
+	var first *checkedConfig
+	for _, c := range configs {
+		if c.config.Leader == nil {
+			continue
+		}
+		if first == nil {
+			first = &c
+		}
+		// Several leaders of one cluster are reported by checkClusters.
+		if _, found := leaders[*c.config.ClusterID]; !found {
+			leaders[*c.config.ClusterID] = c
+		}
+	}
+	if first == nil {
+		return []string{"ring: no leader configs found"}
+	}
+
+	nClusters := *first.config.Leader.NClusters
+	for _, clusterID := range sortedKeys(leaders) {
+		l := leaders[clusterID]
+		if n := *l.config.Leader.NClusters; n != nClusters {
+			fail("%s has nClusters %d, but %s has %d", l.name, n, first.name, nClusters)
+			return problems
+		}
+		if clusterID >= nClusters {
+			fail("%s has clusterID %d, but there are only %d clusters", l.name, clusterID, nClusters)
+		}
+	}
+	for clusterID := range nClusters {
+		if _, found := leaders[clusterID]; !found {
+			fail("no leader config for cluster %d", clusterID)
+		}
+	}
+
+	for clusterID := range nClusters {
+		l, found := leaders[clusterID]
+		r, rightFound := leaders[(clusterID+1)%nClusters]
+		if !found || !rightFound {
+			continue
+		}
+		problems = append(problems, checkLink(l, r)...)
+	}
+	return problems
+}
+
+// Check the link between leader l and its right neighbor r.
+func checkLink(l, r checkedConfig) []string {
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, "ring: "+fmt.Sprintf(format, args...))
+	}
+
+	right, left := l.config.Leader.RightCrypto, r.config.Leader.LeftCrypto
+	if right.Kind != left.Kind {
+		fail("rightCrypto of %s is %s, but leftCrypto of %s is %s", l.name, right.Kind, r.name, left.Kind)
+		return problems
+	}
+	if right.UsesPSK() != left.UsesPSK() {
+		fail("only one of rightCrypto of %s and leftCrypto of %s uses a pre-shared key", l.name, r.name)
+		return problems
+	}
+
+	if right.UsesKyber() {
+		if l.config.Leader.RightPublicKey() != gake.PublicKeyOf([gake.SkLen]byte(r.config.Leader.GetSecretKey())) {
+			fail("rightCrypto public key of %s does not match the secretKey of %s", l.name, r.name)
+		}
+		if r.config.Leader.LeftPublicKey() != gake.PublicKeyOf([gake.SkLen]byte(l.config.Leader.GetSecretKey())) {
+			fail("leftCrypto public key of %s does not match the secretKey of %s", r.name, l.name)
+		}
+	}
+	if right.UsesPSK() && l.config.Leader.RightQKDKey() != r.config.Leader.LeftQKDKey() {
+		fail("pre-shared key of rightCrypto of %s differs from leftCrypto of %s", l.name, r.name)
+	}
+	if right.UsesETSI() && left.UsesETSI() {
+		lOwn, lPeer := l.config.QKDSAEIDs(util.QKDLinkRight)
+		rOwn, rPeer := r.config.QKDSAEIDs(util.QKDLinkLeft)
+		if lPeer != "" && rOwn != "" && lPeer != rOwn {
+			fail("%s requests right link keys for SAE %s, but %s is SAE %s", l.name, lPeer, r.name, rOwn)
+		}
+		if rPeer != "" && lOwn != "" && rPeer != lOwn {
+			fail("%s requests left link keys for SAE %s, but %s is SAE %s", r.name, rPeer, l.name, lOwn)
+		}
+	}
+	return problems
+}
+
+func clusterKind(c *util.ClusterConfig) util.CryptoKind {
+	if !c.Crypto.IsSet() {
+		return util.CryptoKyber
+	}
+	return c.Crypto.Kind
+}
+
+func names(configs []checkedConfig) string {
+	var list []string
+	for _, c := range configs {
+		list = append(list, c.name)
+	}
+	return "(" + strings.Join(list, ", ") + ")"
+}
+
+func sortedKeys[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeTestTopology(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeTopology(topologySpec{
+		Server: "localhost:9000",
+		Clusters: []clusterSpec{
+			{Leader: "alice", Members: []string{"bob", "carol"}},
+			{Leader: "dave"},
+		},
+	}, dir)
+	return dir
+}
+
+func TestCheckGeneratedTopology(t *testing.T) {
+	configs, problems := loadTree(writeTestTopology(t), configPath)
+	problems = append(problems, checkClusters(configs)...)
+	problems = append(problems, checkRing(configs)...)
+	if len(configs) != 4 || len(problems) > 0 {
+		t.Errorf("checked %d configs, problems %v, want 4 configs without problems", len(configs), problems)
+	}
+}
+
+// A member ID beyond the cluster is reported, both by the validation of the file and by the cluster check.
+func TestCheckMemberIDOutOfRange(t *testing.T) {
+	dir := writeTestTopology(t)
+
+	configs, problems := loadTree(dir, configPath)
+	if len(problems) > 0 {
+		t.Fatalf("loadTree(): %v", problems)
+	}
+	for i := range configs {
+		if configs[i].config.Name == "bob" {
+			id := 5
+			configs[i].config.Cluster.MemberID = &id
+		}
+	}
+	problems = checkClusters(configs)
+	if !slices.ContainsFunc(problems, func(p string) bool { return strings.Contains(p, "memberID 5 out of range 0..2") }) {
+		t.Errorf("checkClusters() = %v, want the member ID reported", problems)
+	}
+
+	path := filepath.Join(dir, "bob", configPath)
+	var config map[string]any
+	data, _ := os.ReadFile(path)
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	config["cluster"].(map[string]any)["memberID"] = 5
+	writeJSONToFile(path, config)
+	if _, problems := loadTree(dir, configPath); len(problems) != 1 || !strings.Contains(problems[0], "memberID 5 must be < nMembers 3") {
+		t.Errorf("loadTree() = %v, want the member ID of bob reported", problems)
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"pqgch/gake"
+	"pqgch/util"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Random base64 encoded key of n bytes.
+func randomKey(n int) string {
+	key := make([]byte, n)
+	_, _ = rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// Add the -json flag, selecting JSON instead of text output.
+func jsonFlag(flags *flag.FlagSet) *bool {
+	return flags.Bool("json", false, "print the result as JSON")
+}
+
+// Print the result as indented JSON, or as the given text.
+func report(asJSON bool, v any, text string) {
+	if asJSON {
+		data, _ := json.MarshalIndent(v, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	fmt.Print(text)
+}
+
+// Placeholder for the member ID in the secret key paths of gen-kem.
+const idPlaceholder = "{id}"
+
+func runGenKem(args []string) error {
+	flags := newFlags("gen-kem")
+	pkPath := flags.String("pk", "", "public key file, a publicKeys file if -n is greater than 1")
+	skPath := flags.String("sk", "", "secret key file, must contain "+idPlaceholder+" for the member ID if -n is greater than 1")
+	count := flags.Int("n", 1, "number of keypairs to generate")
+	encrypt := encryptFlag(flags)
+	asJSON := jsonFlag(flags)
+	flags.Parse(args)
+	switch {
+	case *pkPath == "" || *skPath == "" || flags.NArg() > 0:
+		return usageError(flags, "-pk and -sk are required")
+	case *count < 1:
+		return usageError(flags, "-n must be at least 1")
+	case *count > 1 && !strings.Contains(*skPath, idPlaceholder):
+		return usageError(flags, "-sk must contain "+idPlaceholder+" when generating several keypairs")
+	}
+	if *encrypt {
+		passphrase = askPassphrase()
+	}
+
+	keyPairs := genKemKeypairs(*count)
+	result := struct {
+		PublicKeys   string   `json:"publicKeys"`
+		SecretKeys   []string `json:"secretKeys"`
+		Fingerprints []string `json:"fingerprints"`
+	}{PublicKeys: *pkPath}
+	var text strings.Builder
+
+	var pks []string
+	for i, keyPair := range keyPairs {
+		path := *skPath
+		if *count > 1 {
+			path = strings.ReplaceAll(*skPath, idPlaceholder, strconv.Itoa(i))
+		}
+		writeSecretToFile(path, keyPair.sk)
+		pks = append(pks, keyPair.pk)
+
+		fingerprint := fingerprintOf(keyPair.pk)
+		result.SecretKeys = append(result.SecretKeys, path)
+		result.Fingerprints = append(result.Fingerprints, fingerprint)
+		fmt.Fprintf(&text, "wrote secret key %s, fingerprint %s\n", path, fingerprint)
+	}
+	if *count == 1 {
+		writeJSONToFile(*pkPath, map[string]string{"key": pks[0]})
+		fmt.Fprintf(&text, "wrote public key to %s\n", *pkPath)
+	} else {
+		writeJSONToFile(*pkPath, map[string][]string{"publicKeys": pks})
+		fmt.Fprintf(&text, "wrote public keys of members 0..%d to %s\n", *count-1, *pkPath)
+	}
+
+	report(*asJSON, result, text.String())
+	return nil
+}
+
+func runGenPSK(args []string) error {
+	return genSharedKey("gen-psk", gake.SsLen, args)
+}
+
+func runGenClusterSS(args []string) error {
+	return genSharedKey("gen-cluster-ss", 2*gake.SsLen, args)
+}
+
+// Generate a random key of size bytes, shared by the participants of a link or of a cluster.
+func genSharedKey(name string, size int, args []string) error {
+	flags := newFlags(name)
+	out := flags.String("o", "", "key file to write")
+	encrypt := encryptFlag(flags)
+	asJSON := jsonFlag(flags)
+	flags.Parse(args)
+	if *out == "" || flags.NArg() > 0 {
+		return usageError(flags, "-o is required")
+	}
+	if *encrypt {
+		passphrase = askPassphrase()
+	}
+
+	writeSecretToFile(*out, randomKey(size))
+	report(*asJSON, map[string]any{"path": *out, "size": size},
+		fmt.Sprintf("wrote %d byte key to %s, copy it to every participant using it\n", size, *out))
+	return nil
+}
+
+func runExportPublic(args []string) error {
+	flags := newFlags("export-public")
+	skPath := flags.String("sk", "", "KEM secret key file")
+	out := flags.String("o", "", "public key file to write")
+	asJSON := jsonFlag(flags)
+	flags.Parse(args)
+	if *skPath == "" || *out == "" || flags.NArg() > 0 {
+		return usageError(flags, "-sk and -o are required")
+	}
+
+	pk, err := loadPublicKeyOfSecret(*skPath)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(pk[:])
+	writeJSONToFile(*out, map[string]string{"key": encoded})
+
+	fingerprint := fingerprintOf(encoded)
+	report(*asJSON, map[string]string{"path": *out, "fingerprint": fingerprint},
+		fmt.Sprintf("wrote public key to %s, fingerprint %s\n", *out, fingerprint))
+	return nil
+}
+
+// Load the KEM secret key, decrypting it if needed, and get its public key.
+func loadPublicKeyOfSecret(path string) ([gake.PkLen]byte, error) {
+	sk, err := util.LoadKeyFile(path)
+	if err != nil {
+		return [gake.PkLen]byte{}, err
+	}
+	if len(sk) != gake.SkLen {
+		return [gake.PkLen]byte{}, fmt.Errorf("%s is not a KEM secret key: expected %d bytes, got %d", path, gake.SkLen, len(sk))
+	}
+	return gake.PublicKeyOf([gake.SkLen]byte(sk)), nil
+}
+
+func fingerprintOf(encoded string) string {
+	raw, _ := base64.StdEncoding.DecodeString(encoded)
+	return util.KeyFingerprint(raw)
+}
+
+// Public key found in a file, with the member it belongs to in publicKeys files and rosters.
+type keyEntry struct {
+	ID          *int   `json:"id,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Description of a file with keys, as far as it can be told without the passphrase.
+type keyFileSummary struct {
+	Path         string            `json:"path"`
+	Type         string            `json:"type"`                   // kem-public-key, kem-secret-key, link-psk, cluster-psk, public-keys, roster, encrypted or unknown.
+	Size         int               `json:"size,omitempty"`         // Size of the key in bytes.
+	Keys         []keyEntry        `json:"keys,omitempty"`         // Fingerprints of the public keys.
+	SafetyNumber string            `json:"safetyNumber,omitempty"` // Safety number of the cluster, for publicKeys files and rosters.
+	Encryption   *util.KeyFileInfo `json:"encryption,omitempty"`
+}
+
+// Describe the file. Encrypted keys are only decrypted if unlock is set.
+func summarizeKeyFile(path string, unlock bool) (keyFileSummary, error) {
+	summary := keyFileSummary{Path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return summary, err
+	}
+
+	var blob struct {
+		Key        *string             `json:"key"`
+		PublicKeys []string            `json:"publicKeys"`
+		Members    []util.RosterMember `json:"members"`
+		Ciphertext *string             `json:"ciphertext"`
+	}
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return summary, fmt.Errorf("invalid JSON in %q: %w", path, err)
+	}
+
+	var raw []byte
+	switch {
+	case blob.Members != nil:
+		roster, err := util.LoadRoster(path, len(blob.Members))
+		if err != nil {
+			return summary, err
+		}
+		summary.Type, summary.SafetyNumber = "roster", roster.SafetyNumber()
+		for _, m := range roster.Members {
+			summary.Keys = append(summary.Keys, keyEntry{ID: &m.ID, Name: m.Name, Fingerprint: m.Fingerprint()})
+		}
+		return summary, nil
+	case blob.PublicKeys != nil:
+		summary.Type, summary.SafetyNumber = "public-keys", util.RosterOfPublicKeys(blob.PublicKeys).SafetyNumber()
+		for i, pk := range blob.PublicKeys {
+			summary.Keys = append(summary.Keys, keyEntry{ID: &i, Fingerprint: fingerprintOf(pk)})
+		}
+		return summary, nil
+	case blob.Ciphertext != nil:
+		info, _ := util.EncryptedKeyFileInfo(data)
+		summary.Type, summary.Encryption = "encrypted", &info
+		if !unlock {
+			return summary, nil
+		}
+		if raw, err = util.LoadKeyFile(path); err != nil {
+			return summary, err
+		}
+	case blob.Key != nil:
+		if raw, err = base64.StdEncoding.DecodeString(*blob.Key); err != nil {
+			return summary, fmt.Errorf("key in %q is invalid base64", path)
+		}
+	default:
+		return summary, fmt.Errorf("%s is neither a key file, a publicKeys file nor a roster", path)
+	}
+
+	summary.Size = len(raw)
+	switch len(raw) {
+	case gake.PkLen:
+		summary.Type = "kem-public-key"
+		summary.Keys = []keyEntry{{Fingerprint: util.KeyFingerprint(raw)}}
+	case gake.SkLen:
+		pk := gake.PublicKeyOf([gake.SkLen]byte(raw))
+		summary.Type = "kem-secret-key"
+		summary.Keys = []keyEntry{{Fingerprint: util.KeyFingerprint(pk[:])}}
+	case gake.SsLen:
+		summary.Type = "link-psk"
+	case 2 * gake.SsLen:
+		summary.Type = "cluster-psk"
+	default:
+		summary.Type = "unknown"
+	}
+	return summary, nil
+}
+
+func (s keyFileSummary) String() string {
+	var b strings.Builder
+	e := s.Encryption
+	switch {
+	case s.Type == "encrypted":
+		fmt.Fprintf(&b, "%s: encrypted key, use -unlock to describe it", s.Path)
+	case s.Type == "unknown":
+		fmt.Fprintf(&b, "%s: unknown key of %d bytes (KEM keys of Kyber-%d have %d and %d bytes)", s.Path, s.Size, 256*gake.KyberK, gake.PkLen, gake.SkLen)
+	case s.Size > 0:
+		fmt.Fprintf(&b, "%s: %s, %d bytes", s.Path, s.Type, s.Size)
+	default:
+		fmt.Fprintf(&b, "%s: %s", s.Path, s.Type)
+	}
+	if e != nil {
+		fmt.Fprintf(&b, ", encrypted with %s and %s (t=%d, m=%d KiB, p=%d)", e.KDF, e.Cipher, e.Params.Time, e.Params.Memory, e.Params.Threads)
+	}
+	b.WriteString("\n")
+	for _, k := range s.Keys {
+		b.WriteString("  " + k.String() + "\n")
+	}
+	if s.SafetyNumber != "" {
+		b.WriteString("  safety number: " + s.SafetyNumber + "\n")
+	}
+	return b.String()
+}
+
+func (k keyEntry) String() string {
+	switch {
+	case k.ID != nil && k.Name != "":
+		return fmt.Sprintf("%d %s: %s", *k.ID, k.Name, k.Fingerprint)
+	case k.ID != nil:
+		return fmt.Sprintf("%d: %s", *k.ID, k.Fingerprint)
+	default:
+		return k.Fingerprint
+	}
+}
+
+func runInspect(args []string) error {
+	flags := newFlags("inspect")
+	unlock := flags.Bool("unlock", false, "decrypt encrypted key files to describe the key")
+	asJSON := jsonFlag(flags)
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return usageError(flags, "no files given")
+	}
+
+	var summaries []keyFileSummary
+	var text strings.Builder
+	for _, path := range flags.Args() {
+		summary, err := summarizeKeyFile(path, *unlock)
+		if err != nil {
+			return err
+		}
+		summaries = append(summaries, summary)
+		text.WriteString(summary.String())
+	}
+	report(*asJSON, summaries, text.String())
+	return nil
+}
+
+func runFingerprint(args []string) error {
+	flags := newFlags("fingerprint")
+	asJSON := jsonFlag(flags)
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return usageError(flags, "no files given")
+	}
+
+	type fileFingerprints struct {
+		Path         string     `json:"path"`
+		Keys         []keyEntry `json:"keys"`
+		SafetyNumber string     `json:"safetyNumber,omitempty"`
+	}
+	var results []fileFingerprints
+	var text strings.Builder
+	for _, path := range flags.Args() {
+		// Secret keys are decrypted, their public key is what the others compare.
+		summary, err := summarizeKeyFile(path, true)
+		if err != nil {
+			return err
+		}
+		if len(summary.Keys) == 0 {
+			return fmt.Errorf("%s contains no KEM key (%s)", path, summary.Type)
+		}
+		results = append(results, fileFingerprints{path, summary.Keys, summary.SafetyNumber})
+		for _, k := range summary.Keys {
+			fmt.Fprintf(&text, "%s: %s\n", path, k)
+		}
+		if summary.SafetyNumber != "" {
+			fmt.Fprintf(&text, "%s: safety number %s\n", path, summary.SafetyNumber)
+		}
+	}
+	report(*asJSON, results, text.String())
+	return nil
+}
+
+func runRotate(args []string) error {
+	flags := newFlags("rotate")
+	skPath := flags.String("sk", "", "KEM secret key file to replace, the old one is kept as <file>.old")
+	pkPath := flags.String("pk", "", "public key file to write the new public key to")
+	publicKeysPath := flags.String("public-keys", "", "publicKeys file to update the public key of member -id in")
+	rosterFile := flags.String("roster", "", "roster to update the public key of member -id in")
+	id := flags.Int("id", -1, "member ID in the publicKeys file or roster")
+	encrypt := flags.Bool("e", false, "encrypt the new secret key with a new passphrase, by default it is encrypted like the old one")
+	asJSON := jsonFlag(flags)
+	flags.Parse(args)
+
+	targets := 0
+	for _, path := range []string{*pkPath, *publicKeysPath, *rosterFile} {
+		if path != "" {
+			targets++
+		}
+	}
+	switch {
+	case *skPath == "" || flags.NArg() > 0:
+		return usageError(flags, "-sk is required")
+	case targets != 1:
+		return usageError(flags, "exactly one of -pk, -public-keys and -roster is required")
+	case (*publicKeysPath != "" || *rosterFile != "") && *id < 0:
+		return usageError(flags, "-id is required with -public-keys and -roster")
+	}
+
+	oldData, err := os.ReadFile(*skPath)
+	if err != nil {
+		return err
+	}
+	oldPk, err := loadPublicKeyOfSecret(*skPath)
+	if err != nil {
+		return err
+	}
+	oldEncoded := base64.StdEncoding.EncodeToString(oldPk[:])
+
+	// Check the public key belongs to the old secret key, before anything is written.
+	var update func(pk string)
+	switch {
+	case *publicKeysPath != "":
+		update, err = publicKeysUpdate(*publicKeysPath, *id, oldEncoded)
+	case *rosterFile != "":
+		update, err = rosterUpdate(*rosterFile, *id, oldEncoded)
+	default:
+		update = func(pk string) {
+			writeJSONToFile(*pkPath, map[string]string{"key": pk})
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// The old key was unlocked above, so its passphrase is reused unless a new one is asked for.
+	_, wasEncrypted := util.EncryptedKeyFileInfo(oldData)
+	switch {
+	case *encrypt:
+		passphrase = askPassphrase()
+	case wasEncrypted:
+		passphrase = util.UnlockPassphrase()
+	}
+	backup := *skPath + ".old"
+	writeFile(backup, oldData, 0600)
+
+	keyPair := genKemKeypairs(1)[0]
+	writeSecretToFile(*skPath, keyPair.sk)
+	update(keyPair.pk)
+
+	publicPath := *pkPath + *publicKeysPath + *rosterFile
+	result := map[string]string{
+		"secretKey":      *skPath,
+		"backup":         backup,
+		"publicKey":      publicPath,
+		"oldFingerprint": fingerprintOf(oldEncoded),
+		"fingerprint":    fingerprintOf(keyPair.pk),
+	}
+	report(*asJSON, result, fmt.Sprintf(
+		"replaced %s (old key kept as %s) and updated %s\nold fingerprint %s\nnew fingerprint %s\n"+
+			"distribute %s to everybody using it and reload their configuration\n",
+		*skPath, backup, publicPath, result["oldFingerprint"], result["fingerprint"], publicPath))
+	return nil
+}
+
+// Prepare replacing the public key of member id in a publicKeys file.
+func publicKeysUpdate(path string, id int, oldPk string) (func(string), error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var blob map[string]any
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return nil, fmt.Errorf("invalid JSON in %q: %w", path, err)
+	}
+	pks, _ := blob["publicKeys"].([]any)
+	if id >= len(pks) {
+		return nil, fmt.Errorf("%s has no public key %d", path, id)
+	}
+	if pks[id] != oldPk {
+		return nil, fmt.Errorf("public key %d in %s does not belong to the secret key", id, path)
+	}
+	return func(pk string) {
+		pks[id] = pk
+		writeJSONToFile(path, blob)
+	}, nil
+}
+
+// Prepare replacing the public key of member id in a roster, keeping everything else as it is.
+func rosterUpdate(path string, id int, oldPk string) (func(string), error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var roster util.Roster
+	if err := json.Unmarshal(data, &roster); err != nil {
+		return nil, fmt.Errorf("invalid JSON in %q: %w", path, err)
+	}
+	i := slices.IndexFunc(roster.Members, func(m util.RosterMember) bool { return m.ID == id })
+	if i < 0 {
+		return nil, fmt.Errorf("%s has no member %d", path, id)
+	}
+	if roster.Members[i].PublicKey != oldPk {
+		return nil, fmt.Errorf("public key of member %d in %s does not belong to the secret key", id, path)
+	}
+
+	// Only the public key is replaced in the file, so everything else in it stays as it is written.
+	oldValue, _ := json.Marshal(oldPk)
+	if bytes.Count(data, oldValue) != 1 {
+		return nil, fmt.Errorf("public key of member %d in %s is not written once, replace it by hand", id, path)
+	}
+	return func(pk string) {
+		newValue, _ := json.Marshal(pk)
+		writeFile(path, bytes.Replace(data, oldValue, newValue, 1), 0644)
+	}, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Rotating a key replaces only the public key of the member, the rest of the roster is kept as it is written.
+func TestRosterUpdateKeepsTheFile(t *testing.T) {
+	oldPk, otherPk, newPk := randomKey(8), randomKey(8), randomKey(8)
+	roster := `{
+  "comment": "team A",
+  "members": [
+    {"id": 0, "name": "alice", "publicKey": "` + otherPk + `", "phone": "123"},
+    {"id": 1, "name": "bob", "publicKey": "` + oldPk + `"}
+  ]
+}
+`
+	path := filepath.Join(t.TempDir(), "roster.json")
+	if err := os.WriteFile(path, []byte(roster), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rosterUpdate(path, 0, oldPk); err == nil {
+		t.Error("rosterUpdate() accepted the public key of another member")
+	}
+	if _, err := rosterUpdate(path, 2, oldPk); err == nil {
+		t.Error("rosterUpdate() accepted a missing member")
+	}
+
+	update, err := rosterUpdate(path, 1, oldPk)
+	if err != nil {
+		t.Fatalf("rosterUpdate(): %v", err)
+	}
+	update(newPk)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Replace(roster, oldPk, newPk, 1); string(data) != want {
+		t.Errorf("updated roster:\n%s\nwant:\n%s", data, want)
+	}
+}
@@ -2,15 +2,16 @@ package main
 
 import (
 	"bufio"
-	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 	"pqgch/gake"
 	"pqgch/util"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -38,69 +39,140 @@ var (
 	leftCryptoPath  = "left_pk.json"
 	rightCryptoPath = "right_pk.json"
 	skPath          = "sk.json"
-	pksPath         = "pks.json"
-	clusterPksPath  = "cluster_pks.json"
+	rosterPath      = "roster.json"
 	clusterSkPath   = "cluster_sk.json"
 )
 
+// Passphrase the generated secret keys are encrypted with, nil to write them unencrypted.
+var passphrase []byte
+
+// Subcommand of pqgch-keys.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands []command
+
+// Set in init, as the usage of the commands refers to the list.
+func init() {
+	commands = []command{
+		{"gen-kem", "-pk <file> -sk <file> [-n <count>] [-e]", "generate Kyber KEM keypairs", runGenKem},
+		{"gen-psk", "-o <file> [-e]", "generate a pre-shared key for a link between leaders (2-AKE key)", runGenPSK},
+		{"gen-cluster-ss", "-o <file> [-e]", "generate a pre-shared cluster shared secret", runGenClusterSS},
+		{"fingerprint", "<file>...", "print the fingerprints of public keys, secret keys, publicKeys files and rosters", runFingerprint},
+		{"inspect", "[-unlock] <file>...", "describe key files, publicKeys files and rosters", runInspect},
+		{"rotate", "-sk <file> [-pk <file> | -public-keys <file> -id <n> | -roster <file> -id <n>] [-e]", "replace a KEM keypair and update its public key", runRotate},
+		{"export-public", "-sk <file> -o <file>", "write the public key of a KEM secret key", runExportPublic},
+		{"gen-config", "[-e]", "interactively generate a whole configuration", runGenConfig},
+		{"gen-topology", "-s <spec> -o <dir> [-e]", "generate a whole configuration from a topology spec", runGenTopology},
+		{"check", "[-name <file>] <dir>", "check the configs of a whole deployment against each other", runCheck},
+	}
+}
+
+// Returned by subcommands when their arguments are wrong, after printing the usage.
+var errUsage = errors.New("usage")
+
 func main() {
-	count := flag.Int("c", 1, "number of keypairs to generate")
-	mode := flag.Int("m", 0, "mode for generation - KEM keypair (0), QKD shared secret (1), 2-AKE shared secret (2), whole configuration (3)")
-	flag.Parse()
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+		usage()
+		if len(os.Args) < 2 {
+			os.Exit(2)
+		}
+		return
+	}
 
-	switch *mode {
-	case 0:
-		generateKey(2 * gake.SsLen)
-	case 1:
-		generateKeyPairs(*count)
-	case 2:
-		generateKey(gake.SsLen)
-	case 3:
-		generateConfig()
+	name := os.Args[1]
+	i := slices.IndexFunc(commands, func(c command) bool { return c.name == name })
+	if i < 0 {
+		fmt.Fprintf(os.Stderr, "pqgch-keys: unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
 	}
 
+	if err := commands[i].run(os.Args[2:]); err != nil {
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "pqgch-keys %s: %v\n", name, err)
+		os.Exit(1)
+	}
 }
 
-func generateKey(n int) {
-	key := make([]byte, n)
-	_, _ = rand.Read(key)
-	encodedKey := base64.StdEncoding.EncodeToString(key)
-	writeJSON(map[string]string{
-		"key": encodedKey,
-	})
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: pqgch-keys <command> [flags]\n\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-15s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nrun pqgch-keys <command> -h for the flags of a command")
 }
 
-func generateKeyPairs(n int) {
-	keyPairs := genKemKeypairs(n)
+// Flag set of the subcommand, printing its arguments in the usage.
+func newFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		for _, c := range commands {
+			if c.name == name {
+				fmt.Fprintf(flags.Output(), "usage: pqgch-keys %s %s\n\n%s\n\n", c.name, c.args, c.summary)
+			}
+		}
+		flags.PrintDefaults()
+	}
+	return flags
+}
 
-	if n == 1 {
-		fmt.Println("printing public key")
-		writeJSON(map[string]string{
-			"key": keyPairs[0].pk,
-		})
+// Report wrong arguments of the subcommand together with its usage.
+func usageError(flags *flag.FlagSet, msg string) error {
+	fmt.Fprintf(flags.Output(), "pqgch-keys %s: %s\n", flags.Name(), msg)
+	flags.Usage()
+	return errUsage
+}
 
-		fmt.Println("printing secret key")
-		writeJSON(map[string]string{
-			"key": keyPairs[0].sk,
-		})
-		return
+// Add the -e flag for encrypting the generated secret keys.
+func encryptFlag(flags *flag.FlagSet) *bool {
+	return flags.Bool("e", false, "encrypt the generated secret keys with a passphrase")
+}
+
+func runGenConfig(args []string) error {
+	flags := newFlags("gen-config")
+	encrypt := encryptFlag(flags)
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return usageError(flags, "unexpected arguments")
 	}
+	if *encrypt {
+		passphrase = askPassphrase()
+	}
+	generateConfig()
+	return nil
+}
 
-	fmt.Printf("\nprinting public keys 0..%d\n\n", n-1)
-	var clusterPks []string
-	for i := range n {
-		clusterPks = append(clusterPks, keyPairs[i].pk)
+// Generate the config tree described by the topology spec, without asking anything.
+func runGenTopology(args []string) error {
+	flags := newFlags("gen-topology")
+	specPath := flags.String("s", "", "topology spec to generate the configuration from")
+	prefix := flags.String("o", "", "directory to generate the configuration in")
+	encrypt := encryptFlag(flags)
+	flags.Parse(args)
+	if *specPath == "" || *prefix == "" || flags.NArg() > 0 {
+		return usageError(flags, "the topology spec and the output directory are required")
 	}
-	writeJSON(map[string][]string{
-		"publicKeys": clusterPks,
-	})
 
-	fmt.Printf("\nprinting secret keys 0..%d\n\n", n-1)
-	for i := range n {
-		writeJSON(map[string]string{
-			"key": keyPairs[i].sk,
-		})
+	spec, err := loadTopology(*specPath)
+	if err != nil {
+		return err
+	}
+	if errs := spec.validate(); len(errs) > 0 {
+		return errors.New("invalid topology spec:\n- " + strings.Join(errs, "\n- "))
+	}
+	if *encrypt {
+		passphrase = askPassphrase()
 	}
+	writeTopology(spec, *prefix)
+	fmt.Println("all configs generated successfully to: " + *prefix)
+	return nil
 }
 
 func generateConfig() {
@@ -122,8 +194,7 @@ func generateConfig() {
 		return
 	}
 
-	leaderKeypairs := genKemKeypairs(nClusters)
-
+	spec := topologySpec{Server: server}
 	for i := range nClusters {
 		fmt.Printf("\ncluster %d:\n", i+1)
 		fmt.Print("number of members in this cluster (including leader)? ")
@@ -134,102 +205,77 @@ func generateConfig() {
 			nMembers = 1
 		}
 
-		leaderName := fmt.Sprintf("leader%d", i+1)
-
-		skFilePath := filepath.Join(prefix, leaderName, skPath)
-		leftPkFilePath := filepath.Join(prefix, leaderName, leftCryptoPath)
-		rightPkFilePath := filepath.Join(prefix, leaderName, rightCryptoPath)
-
-		leftIndex := (i - 1 + nClusters) % nClusters
-		rightIndex := (i + 1 + nClusters) % nClusters
-
-		writeJSONToFile(skFilePath, map[string]string{
-			"key": leaderKeypairs[i].sk,
-		})
-		writeJSONToFile(leftPkFilePath, map[string]string{
-			"key": leaderKeypairs[leftIndex].pk,
-		})
-		writeJSONToFile(rightPkFilePath, map[string]string{
-			"key": leaderKeypairs[rightIndex].pk,
-		})
-
-		clusterKeyPairs := genKemKeypairs(nMembers)
-		var clusterPks []string
-		for _, keyPair := range clusterKeyPairs {
-			clusterPks = append(clusterPks, keyPair.pk)
-		}
-
-		leaderConfig := util.BaseConfig{
-			Server:    server,
-			Name:      leaderName,
-			ClusterID: &i,
-			Leader: &util.LeaderConfig{
-				NClusters:   &nClusters,
-				LeftCrypto:  leftCryptoPath,
-				RightCrypto: rightCryptoPath,
-				SecretKey:   skPath,
-			},
-		}
-
-		if nMembers > 1 {
-			clusterPksFilePath := filepath.Join(prefix, leaderName, clusterPksPath)
-			writeJSONToFile(clusterPksFilePath, map[string][]string{
-				"publicKeys": clusterPks,
-			})
-			clusterSkFilePath := filepath.Join(prefix, leaderName, clusterSkPath)
-			writeJSONToFile(clusterSkFilePath, map[string]string{
-				"key": clusterKeyPairs[nMembers-1].sk,
-			})
-
-			memberID := nMembers - 1
-			leaderConfig.Cluster = &util.ClusterConfig{
-				NMembers:   &nMembers,
-				MemberID:   &memberID,
-				PublicKeys: clusterPksPath,
-				SecretKey:  clusterSkPath,
-			}
-		}
-		leaderConfigFilePath := filepath.Join(prefix, leaderName, configPath)
-		writeJSONToFile(leaderConfigFilePath, leaderConfig)
-
+		cluster := clusterSpec{Leader: fmt.Sprintf("leader%d", i+1)}
 		for j := range nMembers - 1 {
-			memberName := fmt.Sprintf("member%d_cluster%d", j+1, i+1)
-			clusterPksFilePath := filepath.Join(prefix, memberName, pksPath)
-			writeJSONToFile(clusterPksFilePath, map[string][]string{
-				"publicKeys": clusterPks,
-			})
-			clusterSkFilePath := filepath.Join(prefix, memberName, skPath)
-			writeJSONToFile(clusterSkFilePath, map[string]string{
-				"key": clusterKeyPairs[j].sk,
-			})
-
-			memberConfig := util.BaseConfig{
-				Server:    server,
-				Name:      memberName,
-				ClusterID: &i,
-				Cluster: &util.ClusterConfig{
-					MemberID:   &j,
-					NMembers:   &nMembers,
-					PublicKeys: pksPath,
-					SecretKey:  skPath,
-				},
-			}
-
-			memberConfigPath := filepath.Join(prefix, memberName, configPath)
-			writeJSONToFile(memberConfigPath, memberConfig)
+			cluster.Members = append(cluster.Members, fmt.Sprintf("member%d_cluster%d", j+1, i+1))
 		}
+		spec.Clusters = append(spec.Clusters, cluster)
 	}
+	writeTopology(spec, prefix)
 
 	fmt.Println("\nall configs generated successfully to: " + prefix)
 }
 
 func writeJSONToFile(path string, v any) {
-	os.MkdirAll(filepath.Dir(path), os.ModePerm)
 	data, _ := json.MarshalIndent(v, "", "  ")
-	os.WriteFile(path, data, 0666)
+	writeFile(path, data, 0644)
 }
 
-func writeJSON(v any) {
-	data, _ := json.MarshalIndent(v, "", "  ")
-	fmt.Println(string(data))
+// Write the base64 encoded secret key, encrypted if a passphrase was given.
+// Only the owner can read the file.
+func writeSecretToFile(path string, key string) {
+	writeFile(path, secretKeyFile(key), 0600)
+}
+
+func writeFile(path string, data []byte, perm os.FileMode) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot create directory for %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(path, data, perm); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot write %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	// WriteFile keeps the permissions of existing files.
+	os.Chmod(path, perm)
+}
+
+// Contents of the key file with the base64 encoded secret key.
+func secretKeyFile(key string) []byte {
+	if passphrase == nil {
+		data, _ := json.MarshalIndent(map[string]string{"key": key}, "", "  ")
+		return data
+	}
+
+	raw, _ := base64.StdEncoding.DecodeString(key)
+	data, err := util.EncryptKey(raw, passphrase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot encrypt key: %v\n", err)
+		os.Exit(1)
+	}
+	return data
+}
+
+// Ask for the passphrase twice, so a typo does not make the keys unusable.
+// The passphrase can also be given in the environment, as when running the members and leaders.
+func askPassphrase() []byte {
+	if env, found := os.LookupEnv(util.PassphraseEnv); found {
+		return []byte(env)
+	}
+	for {
+		first, err := util.ReadPassphrase("enter passphrase for the secret keys: ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		second, err := util.ReadPassphrase("repeat passphrase: ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if len(first) > 0 && string(first) == string(second) {
+			return first
+		}
+		fmt.Println("passphrases are empty or do not match, try again")
+	}
 }
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pqgch/gake"
+	"pqgch/util"
+	"slices"
+	"sort"
+	"strings"
+)
+
+var (
+	clusterPskPath = "cluster_psk.json"
+	leftPskPath    = "left_psk.json"
+	rightPskPath   = "right_psk.json"
+)
+
+// Topology of the whole group, from which the config tree is generated.
+// Every participant gets a directory named after it, so the names have to be unique in the whole group.
+type topologySpec struct {
+	Server   string        `json:"server"`
+	Clusters []clusterSpec `json:"clusters"`
+	QKD      *qkdSpec      `json:"qkd,omitempty"` // Credentials for the KMEs, written to every participant using one.
+}
+
+// HTTPS credentials for the KMEs. {name} in the paths is replaced by the name of the participant,
+// so every SAE can get its own client certificate.
+type qkdSpec struct {
+	CACert          string `json:"caCert,omitempty"`
+	ClientCert      string `json:"clientCert,omitempty"`
+	ClientKey       string `json:"clientKey,omitempty"`
+	MockSAEIDHeader bool   `json:"mockSaeIdHeader,omitempty"`
+}
+
+type clusterSpec struct {
+	Leader  string      `json:"leader,omitempty"`  // Name of the leader, leader<n> if not set. The leader is the last member of the cluster.
+	Members []string    `json:"members,omitempty"` // Names of the other members of the cluster.
+	Crypto  *sourceSpec `json:"crypto,omitempty"`  // Source of the cluster key, Kyber-GAKE if not set.
+	Right   *sourceSpec `json:"right,omitempty"`   // Source of the key of the link to the leader of the next cluster, Kyber if not set.
+}
+
+// Crypto source of a cluster or of a link. Pre-shared keys are generated, KME endpoints are taken from the spec.
+// The SAE IDs default to the names of the participants and are written to the qkd sections of their configs.
+type sourceSpec struct {
+	Kind         util.CryptoKind   `json:"kind"`
+	URL          string            `json:"url,omitempty"`          // ETSI API endpoint of the KME of this cluster, or of its leader for links.
+	SAEID        string            `json:"saeId,omitempty"`        // SAE ID of the leader of the cluster, or of this leader for links.
+	MemberSAEIDs map[string]string `json:"memberSaeIds,omitempty"` // Clusters only, SAE IDs of the other members by name.
+	PeerURL      string            `json:"peerUrl,omitempty"`      // Links only, endpoint of the KME of the next leader. Defaults to url.
+	PeerSAEID    string            `json:"peerSaeId,omitempty"`    // Links only, SAE ID of the next leader.
+}
+
+func loadTopology(path string) (topologySpec, error) {
+	var spec topologySpec
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return spec, fmt.Errorf("cannot read topology spec %q: %w", path, err)
+	}
+	// Unknown fields are rejected, so a misspelled or unsupported setting is not silently ignored.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return spec, fmt.Errorf("invalid topology spec %q: %w", path, err)
+	}
+	for i := range spec.Clusters {
+		if spec.Clusters[i].Leader == "" {
+			spec.Clusters[i].Leader = fmt.Sprintf("leader%d", i+1)
+		}
+	}
+	return spec, nil
+}
+
+func (s *topologySpec) validate() []string {
+	var errs []string
+
+	if strings.TrimSpace(s.Server) == "" {
+		errs = append(errs, "missing required field: server")
+	}
+	if len(s.Clusters) < 2 {
+		errs = append(errs, "at least 2 clusters are required")
+	}
+
+	names := make(map[string]bool)
+	for i, c := range s.Clusters {
+		for _, name := range append([]string{c.Leader}, c.Members...) {
+			switch {
+			case strings.TrimSpace(name) == "":
+				errs = append(errs, fmt.Sprintf("cluster %d: empty member name", i+1))
+			case len(name) > gake.PidLen:
+				errs = append(errs, fmt.Sprintf("cluster %d: name %q is longer than %d bytes", i+1, name, gake.PidLen))
+			case name != filepath.Base(name) || name == "." || name == "..":
+				errs = append(errs, fmt.Sprintf("cluster %d: name %q cannot be used as a directory name", i+1, name))
+			case names[name]:
+				errs = append(errs, fmt.Sprintf("cluster %d: name %q is used twice", i+1, name))
+			}
+			names[name] = true
+		}
+
+		errs = append(errs, c.Crypto.validate(fmt.Sprintf("cluster %d: crypto", i+1), false)...)
+		errs = append(errs, c.Right.validate(fmt.Sprintf("cluster %d: right", i+1), true)...)
+		if c.Crypto != nil {
+			var unknown []string
+			for name := range c.Crypto.MemberSAEIDs {
+				if !slices.Contains(c.Members, name) {
+					unknown = append(unknown, name)
+				}
+			}
+			sort.Strings(unknown)
+			for _, name := range unknown {
+				errs = append(errs, fmt.Sprintf("cluster %d: crypto: memberSaeIds: %q is not a member of the cluster", i+1, name))
+			}
+		}
+	}
+
+	return errs
+}
+
+func (s *sourceSpec) validate(name string, link bool) []string {
+	if s == nil {
+		return nil
+	}
+
+	var errs []string
+	switch s.Kind {
+	case util.CryptoKyber, util.CryptoPSK, util.CryptoHybrid:
+	case util.CryptoQKD:
+		if s.URL == "" {
+			errs = append(errs, fmt.Sprintf("%s: qkd-etsi requires url", name))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("%s: unknown kind %q (must be kyber, qkd-etsi, psk or hybrid)", name, s.Kind))
+	}
+	if !link && (s.PeerURL != "" || s.PeerSAEID != "") {
+		errs = append(errs, fmt.Sprintf("%s: peerUrl and peerSaeId are only used for links", name))
+	}
+	if link && len(s.MemberSAEIDs) > 0 {
+		errs = append(errs, fmt.Sprintf("%s: memberSaeIds are only used for clusters", name))
+	}
+	if !s.usesETSI() && (s.SAEID != "" || s.PeerSAEID != "" || len(s.MemberSAEIDs) > 0) {
+		errs = append(errs, fmt.Sprintf("%s: SAE IDs are only used with a KME url", name))
+	}
+	return errs
+}
+
+// Kyber keys are needed, as they are when no source is given.
+func (s *sourceSpec) usesKyber() bool {
+	return s == nil || s.Kind == util.CryptoKyber || s.Kind == util.CryptoHybrid
+}
+
+// A pre-shared key has to be generated, also for hybrid sources without a KME.
+func (s *sourceSpec) usesPSK() bool {
+	return s != nil && (s.Kind == util.CryptoPSK || (s.Kind == util.CryptoHybrid && s.URL == ""))
+}
+
+// Keys are requested from a KME over the ETSI API.
+func (s *sourceSpec) usesETSI() bool {
+	return s != nil && (s.Kind == util.CryptoQKD || (s.Kind == util.CryptoHybrid && s.URL != ""))
+}
+
+// SAE ID of the leader of the cluster, or of the leader the link is specified on.
+func (s *sourceSpec) saeID(leader string) string {
+	return cmp.Or(s.SAEID, leader)
+}
+
+// SAE ID of the leader of the next cluster on a link.
+func (s *sourceSpec) peerSAEID(leader string) string {
+	return cmp.Or(s.PeerSAEID, leader)
+}
+
+// SAE ID of a member of the cluster other than its leader.
+func (s *sourceSpec) memberSAEID(member string) string {
+	return cmp.Or(s.MemberSAEIDs[member], member)
+}
+
+// Crypto source of one side of a link. The left side of the link belongs to the leader
+// the link is specified on, the right side to the leader of the next cluster.
+func (s *sourceSpec) linkSource(leftSide bool, publicKey, psk string) *util.CryptoSource {
+	source := &util.CryptoSource{Kind: util.CryptoKyber}
+	if s != nil {
+		source.Kind = s.Kind
+		if s.usesPSK() {
+			source.Path = psk
+		} else if s.Kind != util.CryptoKyber {
+			source.URL = s.URL
+			if !leftSide && s.PeerURL != "" {
+				source.URL = s.PeerURL
+			}
+		}
+	}
+	if s.usesKyber() {
+		source.PublicKey = publicKey
+	}
+	return source
+}
+
+// Get the qkd section of the participant with the credentials of the spec. It has no links yet.
+func (s *topologySpec) qkdConfig(name string) *util.QKDConfig {
+	qkd := &util.QKDConfig{}
+	if s.QKD != nil {
+		expand := func(path string) string { return strings.ReplaceAll(path, "{name}", name) }
+		qkd.CACert, qkd.ClientCert, qkd.ClientKey = expand(s.QKD.CACert), expand(s.QKD.ClientCert), expand(s.QKD.ClientKey)
+		qkd.MockSAEIDHeader = s.QKD.MockSAEIDHeader
+	}
+	return qkd
+}
+
+// Only participants requesting keys from a KME get a qkd section.
+func qkdSection(qkd *util.QKDConfig) *util.QKDConfig {
+	if qkd.Cluster == nil && qkd.Left == nil && qkd.Right == nil {
+		return nil
+	}
+	return qkd
+}
+
+// Generate the config tree at prefix, with a directory for every leader and member.
+func writeTopology(spec topologySpec, prefix string) {
+	nClusters := len(spec.Clusters)
+	leaderKeyPairs := genKemKeypairs(nClusters)
+
+	// Pre-shared keys of the links, linkKeys[i] is shared by leader i and its right neighbor.
+	linkKeys := make([]string, nClusters)
+	for i, c := range spec.Clusters {
+		if c.Right.usesPSK() {
+			linkKeys[i] = randomKey(gake.SsLen)
+		}
+	}
+
+	for i, c := range spec.Clusters {
+		leaderName := c.Leader
+		leftIndex := (i - 1 + nClusters) % nClusters
+		rightIndex := (i + 1 + nClusters) % nClusters
+		left := spec.Clusters[leftIndex].Right
+		leftLeader, rightLeader := spec.Clusters[leftIndex].Leader, spec.Clusters[rightIndex].Leader
+
+		leaderDir := filepath.Join(prefix, leaderName)
+		writeSecretToFile(filepath.Join(leaderDir, skPath), leaderKeyPairs[i].sk)
+		if left.usesKyber() {
+			writeJSONToFile(filepath.Join(leaderDir, leftCryptoPath), map[string]string{
+				"key": leaderKeyPairs[leftIndex].pk,
+			})
+		}
+		if c.Right.usesKyber() {
+			writeJSONToFile(filepath.Join(leaderDir, rightCryptoPath), map[string]string{
+				"key": leaderKeyPairs[rightIndex].pk,
+			})
+		}
+		if left.usesPSK() {
+			writeSecretToFile(filepath.Join(leaderDir, leftPskPath), linkKeys[leftIndex])
+		}
+		if c.Right.usesPSK() {
+			writeSecretToFile(filepath.Join(leaderDir, rightPskPath), linkKeys[i])
+		}
+
+		// The link to the left neighbor is specified on its cluster, so this leader is its next leader.
+		leaderQKD := spec.qkdConfig(leaderName)
+		if left.usesETSI() {
+			leaderQKD.Left = &util.QKDLinkConfig{SAEID: left.peerSAEID(leaderName), PeerSAEID: left.saeID(leftLeader)}
+		}
+		if c.Right.usesETSI() {
+			leaderQKD.Right = &util.QKDLinkConfig{SAEID: c.Right.saeID(leaderName), PeerSAEID: c.Right.peerSAEID(rightLeader)}
+		}
+
+		leaderConfig := util.BaseConfig{
+			Server:    spec.Server,
+			Name:      leaderName,
+			ClusterID: &i,
+			Leader: &util.LeaderConfig{
+				NClusters:   &nClusters,
+				LeftCrypto:  left.linkSource(false, leftCryptoPath, leftPskPath),
+				RightCrypto: c.Right.linkSource(true, rightCryptoPath, rightPskPath),
+				SecretKey:   skPath,
+			},
+		}
+
+		// The leader is the last member of its cluster.
+		names := append(append([]string{}, c.Members...), leaderName)
+		nMembers := len(names)
+		if nMembers == 1 {
+			leaderConfig.QKD = qkdSection(leaderQKD)
+			writeJSONToFile(filepath.Join(leaderDir, configPath), leaderConfig)
+			continue
+		}
+
+		var clusterKeyPairs []KeyPair
+		if c.Crypto.usesKyber() {
+			clusterKeyPairs = genKemKeypairs(nMembers)
+		}
+		var clusterKey string
+		if c.Crypto.usesPSK() {
+			clusterKey = randomKey(2 * gake.SsLen)
+		}
+
+		var roster util.Roster
+		for j, name := range names {
+			member := util.RosterMember{ID: j, Name: name}
+			if clusterKeyPairs != nil {
+				member.PublicKey = clusterKeyPairs[j].pk
+			}
+			roster.Members = append(roster.Members, member)
+		}
+
+		for j, name := range names {
+			dir := filepath.Join(prefix, name)
+			memberSkPath := skPath
+			if j == nMembers-1 {
+				memberSkPath = clusterSkPath
+			}
+
+			clusterConfig := &util.ClusterConfig{
+				NMembers: &nMembers,
+				MemberID: &j,
+				Roster:   rosterPath,
+			}
+			if clusterKeyPairs != nil {
+				writeSecretToFile(filepath.Join(dir, memberSkPath), clusterKeyPairs[j].sk)
+				clusterConfig.SecretKey = memberSkPath
+			}
+			if c.Crypto != nil && c.Crypto.Kind != util.CryptoKyber {
+				clusterConfig.Crypto = &util.CryptoSource{Kind: c.Crypto.Kind}
+				if clusterKey != "" {
+					writeSecretToFile(filepath.Join(dir, clusterPskPath), clusterKey)
+					clusterConfig.Crypto.Path = clusterPskPath
+				} else {
+					clusterConfig.Crypto.URL = c.Crypto.URL
+				}
+			}
+			writeJSONToFile(filepath.Join(dir, rosterPath), roster)
+
+			// The leader requests the cluster key for the first member, with the others as additional slaves.
+			// Every member retrieves it from the key stream of the leader.
+			if j == nMembers-1 {
+				if c.Crypto.usesETSI() {
+					leaderQKD.Cluster = &util.QKDLinkConfig{SAEID: c.Crypto.saeID(leaderName), PeerSAEID: c.Crypto.memberSAEID(names[0])}
+					for _, member := range c.Members {
+						leaderQKD.Cluster.MemberSAEIDs = append(leaderQKD.Cluster.MemberSAEIDs, c.Crypto.memberSAEID(member))
+					}
+				}
+				leaderConfig.Cluster = clusterConfig
+				leaderConfig.QKD = qkdSection(leaderQKD)
+				writeJSONToFile(filepath.Join(dir, configPath), leaderConfig)
+				continue
+			}
+			memberQKD := spec.qkdConfig(name)
+			if c.Crypto.usesETSI() {
+				memberQKD.Cluster = &util.QKDLinkConfig{SAEID: c.Crypto.memberSAEID(name), PeerSAEID: c.Crypto.saeID(leaderName)}
+			}
+			writeJSONToFile(filepath.Join(dir, configPath), util.BaseConfig{
+				Server:    spec.Server,
+				Name:      name,
+				ClusterID: &i,
+				Cluster:   clusterConfig,
+				QKD:       qkdSection(memberQKD),
+			})
+		}
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"pqgch/gake"
+	"slices"
 	"strings"
+	"time"
 )
 
 type BaseConfig struct {
@@ -16,27 +19,87 @@ type BaseConfig struct {
 	ClusterID *int           `json:"clusterID"`
 	Cluster   *ClusterConfig `json:"cluster,omitempty"`
 	Leader    *LeaderConfig  `json:"leaders,omitempty"`
+	Mesh      *MeshConfig    `json:"mesh,omitempty"`
+	QKD       *QKDConfig     `json:"qkd,omitempty"`
 }
 
 type ClusterConfig struct {
-	NMembers   *int   `json:"nMembers"`
-	MemberID   *int   `json:"memberID"`
-	PublicKeys string `json:"publicKeys,omitempty"`
-	SecretKey  string `json:"secretKey,omitempty"`
-	Crypto     string `json:"crypto,omitempty"`
+	NMembers   *int          `json:"nMembers"`
+	MemberID   *int          `json:"memberID"`
+	PublicKeys string        `json:"publicKeys,omitempty"`
+	Roster     string        `json:"roster,omitempty"` // Roster file with the names and public keys of the members, used instead of publicKeys.
+	SecretKey  string        `json:"secretKey,omitempty"`
+	Crypto     *CryptoSource `json:"crypto,omitempty"` // Source of the cluster key, Kyber-GAKE if not set.
 }
 
 type LeaderConfig struct {
-	NClusters   *int   `json:"nClusters"`
-	LeftCrypto  string `json:"leftCrypto"`
-	RightCrypto string `json:"rightCrypto"`
-	SecretKey   string `json:"secretKey"`
-}
+	NClusters   *int          `json:"nClusters"`
+	LeftCrypto  *CryptoSource `json:"leftCrypto"`
+	RightCrypto *CryptoSource `json:"rightCrypto"`
+	SecretKey   string        `json:"secretKey"`
+	MailboxSize int           `json:"mailboxSize,omitempty"` // Number of text messages kept per epoch for members who connect later, 0 disables the mailbox.
+}
+
+// Configuration of the serverless mode, in which the participants connect directly to each other.
+type MeshConfig struct {
+	Listen         string   `json:"listen"`                   // Address to accept connections from other participants on.
+	Peers          []string `json:"peers,omitempty"`          // Static list of addresses of the other participants.
+	Discovery      string   `json:"discovery,omitempty"`      // Set to "multicast" to discover participants on the LAN.
+	MulticastGroup string   `json:"multicastGroup,omitempty"` // Multicast group used for discovery.
+}
+
+// Credentials for connecting to the key management entities (KMEs) over HTTPS.
+// The top-level certificate and key are used for every link that does not specify its own.
+type QKDConfig struct {
+	CACert     string          `json:"caCert,omitempty"`     // PEM file with the CA certificates used to verify the KME.
+	ClientCert string          `json:"clientCert,omitempty"` // PEM file with our client certificate.
+	ClientKey  string          `json:"clientKey,omitempty"`  // PEM file with the private key of the client certificate.
+	Cluster    *QKDLinkConfig  `json:"cluster,omitempty"`
+	Left       *QKDLinkConfig  `json:"left,omitempty"`
+	Right      *QKDLinkConfig  `json:"right,omitempty"`
+	Retry      *QKDRetryConfig `json:"retry,omitempty"`
+	PoolSize   int             `json:"poolSize,omitempty"` // Number of keys prefetched per link, 0 requests keys only when needed.
+	// Send our SAE ID in the X-SAE-ID header. ETSI GS QKD 014 identifies the SAE by its client certificate,
+	// the header is only understood by the mock KME.
+	MockSAEIDHeader bool `json:"mockSaeIdHeader,omitempty"`
+}
+
+// Retry policy for requests to the KME. Unset fields keep their default values.
+type QKDRetryConfig struct {
+	MaxAttempts      *int `json:"maxAttempts,omitempty"` // 0 retries until the key is delivered.
+	TimeoutMs        int  `json:"timeoutMs,omitempty"`
+	InitialBackoffMs int  `json:"initialBackoffMs,omitempty"`
+	MaxBackoffMs     int  `json:"maxBackoffMs,omitempty"`
+	DeadlineMs       *int `json:"deadlineMs,omitempty"` // Time the protocol waits for a key, 0 waits forever.
+}
+
+// Per-SAE settings of a single QKD link.
+type QKDLinkConfig struct {
+	SAEID      string `json:"saeId,omitempty"`      // Our SAE ID on this link.
+	PeerSAEID  string `json:"peerSaeId,omitempty"`  // SAE ID of the other side, appended to the ETSI URL.
+	CACert     string `json:"caCert,omitempty"`     // Overrides the top-level CA certificates.
+	ClientCert string `json:"clientCert,omitempty"` // Overrides the top-level client certificate.
+	ClientKey  string `json:"clientKey,omitempty"`  // Overrides the top-level client key.
+	// SAE IDs of all cluster members, used by the cluster leader to request a key delivered to every member at once.
+	// Only meaningful for the cluster link.
+	MemberSAEIDs []string `json:"memberSaeIds,omitempty"`
+}
+
+// QKD link a key is requested for.
+type QKDLink string
+
+const (
+	QKDLinkCluster QKDLink = "cluster"
+	QKDLinkLeft    QKDLink = "left"
+	QKDLinkRight   QKDLink = "right"
+)
 
 func (c *BaseConfig) validate() []string {
 	var errs []string
 
-	if strings.TrimSpace(c.Server) == "" {
+	if c.Mesh != nil {
+		errs = append(errs, c.Mesh.validate()...)
+	} else if strings.TrimSpace(c.Server) == "" {
 		errs = append(errs, "missing required field: server")
 	}
 	if strings.TrimSpace(c.Name) == "" {
@@ -53,6 +116,10 @@ func (c *BaseConfig) validate() []string {
 	if c.Cluster != nil {
 		if err := c.Cluster.validate(); err != nil {
 			errs = append(errs, err...)
+		} else if roster, _ := c.Cluster.loadRoster(); roster != nil {
+			if m, _ := roster.Member(*c.Cluster.MemberID); m.Name != c.Name {
+				errs = append(errs, fmt.Sprintf("name %q does not match the roster name %q of member %d", c.Name, m.Name, *c.Cluster.MemberID))
+			}
 		}
 	}
 	if c.Leader != nil {
@@ -60,23 +127,16 @@ func (c *BaseConfig) validate() []string {
 			errs = append(errs, err...)
 		}
 	}
+	if c.QKD != nil {
+		errs = append(errs, c.QKD.validate()...)
+	}
+	if len(errs) == 0 {
+		errs = append(errs, c.validateSAEIDs()...)
+	}
 
 	return errs
 }
 
-func exactlyOne(bools ...bool) bool {
-	count := 0
-	for _, b := range bools {
-		if b {
-			count++
-			if count > 1 {
-				return false
-			}
-		}
-	}
-	return count == 1
-}
-
 func (c *ClusterConfig) validate() []string {
 	var errs []string
 
@@ -85,47 +145,50 @@ func (c *ClusterConfig) validate() []string {
 	}
 	if c.MemberID == nil || *c.MemberID < 0 {
 		errs = append(errs, "memberID must be set and >= 0")
+	} else if c.NMembers != nil && *c.MemberID >= *c.NMembers {
+		errs = append(errs, fmt.Sprintf("memberID %d must be < nMembers %d", *c.MemberID, *c.NMembers))
 	}
 
 	if len(errs) > 0 {
 		return errs
 	}
 
-	hasCrypto := strings.TrimSpace(c.Crypto) != ""
 	hasPK := strings.TrimSpace(c.PublicKeys) != ""
 	hasSK := strings.TrimSpace(c.SecretKey) != ""
-	hasPair := hasPK && hasSK
+	hasRoster := strings.TrimSpace(c.Roster) != ""
 
-	if !exactlyOne(hasCrypto, hasPair) {
-		if !hasCrypto && !hasPair {
-			errs = append(errs, "must provide either crypto OR (publicKeys + secretKey)")
-		} else if hasCrypto && (hasPK != hasSK) {
-			errs = append(errs, "when crypto is set, publicKeys and secretKey must be absent (not just one of them)")
-		} else {
-			errs = append(errs, "use either crypto OR (publicKeys + secretKey), not both")
+	var roster *Roster
+	if hasRoster {
+		if hasPK {
+			return []string{"roster replaces publicKeys, remove publicKeys"}
+		}
+		var err error
+		if roster, err = c.loadRoster(); err != nil {
+			return []string{fmt.Sprintf("roster file invalid: %v", err)}
 		}
 	}
 
-	if hasCrypto {
-		crypto := strings.TrimSpace(c.Crypto)
-		low := strings.ToLower(crypto)
-		switch {
-		case strings.HasPrefix(low, "path "):
-			p := strings.TrimSpace(crypto[5:])
-			if err := validateJSONKeyLen(p, 2*gake.SsLen); err != nil {
-				errs = append(errs, fmt.Sprintf("QKD key at path is invalid: %v", err))
-			}
-		case strings.HasPrefix(low, "url "):
-		default:
-			errs = append(errs, "crypto must start with 'path ' and point to a JSON-wrapped QKD key or with 'url ' and contain an URL to the ETSI server")
+	if c.Crypto.IsSet() {
+		if cryptoErrs := c.Crypto.validate("crypto", true); len(cryptoErrs) > 0 {
+			return cryptoErrs
+		}
+		if !c.UsesKyber() && (hasPK || hasSK) {
+			errs = append(errs, fmt.Sprintf("%s crypto does not use publicKeys and secretKey, remove them", c.Crypto.Kind))
+		}
+		if _, err := Resolver.Resolve(c.Crypto, QKDLinkCluster.KeySize()); err != nil {
+			errs = append(errs, fmt.Sprintf("crypto: %v", err))
 		}
 	}
 
-	if !hasCrypto {
-		if !hasPK || !hasSK {
-			errs = append(errs, "Kyber-GAKE mode requires both: publicKeys and secretKey")
+	if c.UsesKyber() {
+		if !(hasPK || hasRoster) || !hasSK {
+			errs = append(errs, "Kyber-GAKE mode requires both: publicKeys (or roster) and secretKey")
 		} else {
-			if err := validatePublicKeysFile(c.PublicKeys, *c.NMembers); err != nil {
+			if hasRoster {
+				if _, err := roster.PublicKeys(); err != nil {
+					errs = append(errs, fmt.Sprintf("roster file invalid: %v", err))
+				}
+			} else if err := validatePublicKeysFile(c.PublicKeys, *c.NMembers); err != nil {
 				errs = append(errs, fmt.Sprintf("publicKeys file invalid: %v", err))
 			}
 			if err := validateJSONKeyLen(c.SecretKey, gake.SkLen); err != nil {
@@ -137,12 +200,63 @@ func (c *ClusterConfig) validate() []string {
 	return errs
 }
 
+func (c *MeshConfig) validate() []string {
+	var errs []string
+
+	if strings.TrimSpace(c.Listen) == "" {
+		errs = append(errs, "mesh: missing required field: listen")
+	}
+	if c.Discovery != "" && !c.HasMulticast() {
+		errs = append(errs, fmt.Sprintf("mesh: unknown discovery %q (only \"multicast\" is supported)", c.Discovery))
+	}
+	if len(c.Peers) == 0 && !c.HasMulticast() {
+		errs = append(errs, "mesh: must provide peers and/or enable multicast discovery")
+	}
+
+	return errs
+}
+
+func (c *QKDConfig) validate() []string {
+	var errs []string
+
+	for _, link := range []QKDLink{QKDLinkCluster, QKDLinkLeft, QKDLinkRight} {
+		if _, err := c.tlsConfig(link); err != nil {
+			errs = append(errs, fmt.Sprintf("qkd: %s link: %v", link, err))
+		}
+	}
+	if (c.Left != nil && len(c.Left.MemberSAEIDs) > 0) || (c.Right != nil && len(c.Right.MemberSAEIDs) > 0) {
+		errs = append(errs, "qkd: memberSaeIds can only be set for the cluster link")
+	}
+	if c.Cluster != nil && slices.Contains(c.Cluster.MemberSAEIDs, "") {
+		errs = append(errs, "qkd: cluster link: memberSaeIds must not contain empty SAE IDs")
+	}
+	if c.PoolSize < 0 {
+		errs = append(errs, "qkd: poolSize must be >= 0")
+	}
+	if r := c.Retry; r != nil {
+		if r.MaxAttempts != nil && *r.MaxAttempts < 0 {
+			errs = append(errs, "qkd: retry: maxAttempts must be >= 0")
+		}
+		if r.TimeoutMs < 0 || r.InitialBackoffMs < 0 || r.MaxBackoffMs < 0 {
+			errs = append(errs, "qkd: retry: timeoutMs, initialBackoffMs and maxBackoffMs must be >= 0")
+		}
+		if r.DeadlineMs != nil && *r.DeadlineMs < 0 {
+			errs = append(errs, "qkd: retry: deadlineMs must be >= 0")
+		}
+	}
+
+	return errs
+}
+
 func (c *LeaderConfig) validate() []string {
 	var errs []string
 
 	if c.NClusters == nil || *c.NClusters <= 0 {
 		errs = append(errs, "nClusters must be set and > 0")
 	}
+	if c.MailboxSize < 0 {
+		errs = append(errs, "mailboxSize must be >= 0")
+	}
 	if strings.TrimSpace(c.SecretKey) == "" {
 		errs = append(errs, "missing required field: secretKey")
 	} else if err := validateJSONKeyLen(c.SecretKey, gake.SkLen); err != nil {
@@ -153,32 +267,22 @@ func (c *LeaderConfig) validate() []string {
 		return errs
 	}
 
-	checkPKFile := func(key, value string) {
-		value = strings.TrimSpace(value)
-		if value == "" {
-			errs = append(errs, fmt.Sprintf("missing required field: %s (must be PK file path, QKD secret key file path or an URL to the ETSI server)", key))
-			return
-		}
-
-		low := strings.ToLower(value)
-
-		if strings.HasPrefix(low, "path ") {
-			p := strings.TrimSpace(value[5:])
-			if err := validateJSONKeyLen(p, gake.SsLen); err != nil {
-				errs = append(errs, fmt.Sprintf("QKD key at path is invalid: %v", err))
-			}
+	checkLink := func(key string, source *CryptoSource, link QKDLink) {
+		if !source.IsSet() {
+			errs = append(errs, fmt.Sprintf("missing required field: %s (must be a kyber, qkd-etsi, psk or hybrid crypto source)", key))
 			return
 		}
-		if strings.HasPrefix(low, "url ") {
+		if linkErrs := source.validate(key, false); len(linkErrs) > 0 {
+			errs = append(errs, linkErrs...)
 			return
 		}
-		if err := validateJSONKeyLen(value, gake.PkLen); err != nil {
-			errs = append(errs, fmt.Sprintf("%s public key file invalid: %v", key, err))
+		if _, err := Resolver.Resolve(source, link.KeySize()); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", key, err))
 		}
 	}
 
-	checkPKFile("leftCrypto", c.LeftCrypto)
-	checkPKFile("rightCrypto", c.RightCrypto)
+	checkLink("leftCrypto", c.LeftCrypto, QKDLinkLeft)
+	checkLink("rightCrypto", c.RightCrypto, QKDLinkRight)
 
 	return errs
 }
@@ -208,31 +312,158 @@ func validatePublicKeysFile(path string, n int) error {
 	return err
 }
 
+// Load the config file and apply the overrides given by PQGCH_* environment variables and by the flags
+// registered with RegisterConfigFlags, in this order of precedence. With an empty path, the whole
+// configuration comes from the overrides.
 func GetConfig(path string) (BaseConfig, error) {
-	var config BaseConfig
+	return loadConfig(path, true)
+}
 
-	configFile, err := os.Open(path)
+// Load the config file as it is written, without the overrides, e.g. for checking the files of a deployment.
+func LoadConfigFile(path string) (BaseConfig, error) {
+	return loadConfig(path, false)
+}
+
+func loadConfig(path string, overrides bool) (BaseConfig, error) {
+	config, err := readConfig(path, overrides)
 	if err != nil {
-		return config, fmt.Errorf("cannot open config %q: %w", path, err)
+		return config, err
 	}
-	defer configFile.Close()
+	if errs := config.validate(); len(errs) > 0 {
+		return config, logError(errs)
+	}
+	return config, nil
+}
 
-	if err := json.NewDecoder(configFile).Decode(&config); err != nil {
-		return config, fmt.Errorf("invalid JSON in %q: %w", path, err)
+// Read the config file and apply the overrides, without validating the result.
+func readConfig(path string, overrides bool) (BaseConfig, error) {
+	var config BaseConfig
+
+	if path != "" {
+		configFile, err := os.Open(path)
+		if err != nil {
+			return config, fmt.Errorf("cannot open config %q: %w", path, err)
+		}
+		defer configFile.Close()
+
+		if err := json.NewDecoder(configFile).Decode(&config); err != nil {
+			return config, fmt.Errorf("invalid JSON in %q: %w", path, err)
+		}
 	}
+	var overridden map[*string]bool
+	if overrides {
+		var err error
+		if overridden, err = config.applyOverrides(); err != nil {
+			return config, err
+		}
+	}
+	config.resolvePaths(filepath.Dir(path), overridden)
+	return config, nil
+}
 
-	errs := config.validate()
-	if len(errs) > 0 {
-		return config, logError(errs)
+// Rewrite the key and certificate paths, so they do not depend on the working directory.
+// Environment variables and a leading ~ are expanded, and relative paths are taken relative to dir,
+// the directory of the config file. Overridden paths stay relative to the working directory.
+func (c *BaseConfig) resolvePaths(dir string, overridden map[*string]bool) {
+	paths := []*string{}
+	addSource := func(s *CryptoSource) {
+		if s != nil {
+			paths = append(paths, &s.PublicKey, &s.Path)
+		}
+	}
+	if c.Cluster != nil {
+		paths = append(paths, &c.Cluster.PublicKeys, &c.Cluster.Roster, &c.Cluster.SecretKey)
+		addSource(c.Cluster.Crypto)
+	}
+	if c.Leader != nil {
+		paths = append(paths, &c.Leader.SecretKey)
+		addSource(c.Leader.LeftCrypto)
+		addSource(c.Leader.RightCrypto)
+	}
+	if c.QKD != nil {
+		paths = append(paths, &c.QKD.CACert, &c.QKD.ClientCert, &c.QKD.ClientKey)
+		for _, link := range []*QKDLinkConfig{c.QKD.Cluster, c.QKD.Left, c.QKD.Right} {
+			if link != nil {
+				paths = append(paths, &link.CACert, &link.ClientCert, &link.ClientKey)
+			}
+		}
 	}
 
-	return config, nil
+	for _, p := range paths {
+		if overridden[p] {
+			*p = resolvePath(".", *p)
+		} else {
+			*p = resolvePath(dir, *p)
+		}
+	}
+}
+
+// Expand environment variables and a leading ~ in path and make it relative to dir, unless it is absolute.
+// Empty paths are left empty.
+func resolvePath(dir, path string) string {
+	path = strings.TrimSpace(os.ExpandEnv(path))
+	if path == "" {
+		return ""
+	}
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[1:])
+		}
+	}
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(dir, path)
 }
 
 func (c *BaseConfig) HasCluster() bool {
 	return c.Cluster != nil
 }
 
+func (c *MeshConfig) HasMulticast() bool {
+	return strings.EqualFold(strings.TrimSpace(c.Discovery), "multicast")
+}
+
+func (c *MeshConfig) MulticastGroupAddr() string {
+	if strings.TrimSpace(c.MulticastGroup) == "" {
+		return defaultMulticastGroup
+	}
+	return c.MulticastGroup
+}
+
+// Get the number of QKD keys prefetched per link.
+func (c *QKDConfig) KeyPoolSize() int {
+	if c == nil {
+		return 0
+	}
+	return c.PoolSize
+}
+
+// Get the retry policy for requests to the KME, filling in the defaults for unset fields.
+func (c *QKDConfig) RetryPolicy() RetryPolicy {
+	policy := DefaultRetryPolicy
+	if c == nil || c.Retry == nil {
+		return policy
+	}
+	if c.Retry.MaxAttempts != nil {
+		policy.MaxAttempts = *c.Retry.MaxAttempts
+	}
+	if c.Retry.TimeoutMs > 0 {
+		policy.Timeout = time.Duration(c.Retry.TimeoutMs) * time.Millisecond
+	}
+	if c.Retry.InitialBackoffMs > 0 {
+		policy.InitialBackoff = time.Duration(c.Retry.InitialBackoffMs) * time.Millisecond
+	}
+	if c.Retry.MaxBackoffMs > 0 {
+		policy.MaxBackoff = time.Duration(c.Retry.MaxBackoffMs) * time.Millisecond
+	}
+	if c.Retry.DeadlineMs != nil {
+		policy.Deadline = time.Duration(*c.Retry.DeadlineMs) * time.Millisecond
+	}
+	policy.MaxBackoff = max(policy.MaxBackoff, policy.InitialBackoff)
+	return policy
+}
+
 func (c *BaseConfig) RightClusterID() int {
 	return (*c.ClusterID + 1) % *c.Leader.NClusters
 }
@@ -245,11 +476,67 @@ func (c *BaseConfig) GetMemberID() int {
 }
 
 func (c *ClusterConfig) GetPublicKeys() [][gake.PkLen]byte {
-	pks, err := getPublicKeys(c.PublicKeys, *c.NMembers)
+	members, err := c.LoadMembers()
+	if err != nil {
+		ExitWithMsg(fmt.Sprintf("failed to load cluster PKs: %v", err))
+	}
+	return members.PublicKeys
+}
+
+// Names and public keys of the members of the cluster. The sessions load them once per configuration,
+// so the files are not read again for every message.
+type ClusterMembers struct {
+	Roster     *Roster            // Nil if the cluster has no roster.
+	PublicKeys [][gake.PkLen]byte // From the roster or the publicKeys file, nil if the cluster does not use Kyber-GAKE.
+}
+
+// Load the roster and the public keys of the members of the cluster.
+func (c *ClusterConfig) LoadMembers() (ClusterMembers, error) {
+	var members ClusterMembers
+	if c == nil {
+		return members, nil
+	}
+	roster, err := c.loadRoster()
 	if err != nil {
-		ExitWithMsg(fmt.Sprintf("failed to load cluster PKs from file %s, error: %v", c.PublicKeys, err))
+		return members, fmt.Errorf("failed to load roster %s: %w", c.Roster, err)
+	}
+	members.Roster = roster
+	if !c.UsesKyber() {
+		return members, nil
+	}
+
+	if roster != nil {
+		if members.PublicKeys, err = roster.PublicKeys(); err != nil {
+			return members, fmt.Errorf("failed to load cluster PKs from roster %s: %w", c.Roster, err)
+		}
+	} else if members.PublicKeys, err = getPublicKeys(c.PublicKeys, *c.NMembers); err != nil {
+		return members, fmt.Errorf("failed to load cluster PKs from file %s: %w", c.PublicKeys, err)
+	}
+	return members, nil
+}
+
+// Load the roster of the cluster, nil if none is configured.
+func (c *ClusterConfig) loadRoster() (*Roster, error) {
+	if strings.TrimSpace(c.Roster) == "" {
+		return nil, nil
+	}
+	return LoadRoster(c.Roster, *c.NMembers)
+}
+
+// Get the roster, or one built from the publicKeys file, to show the keys of the members for verification.
+// Nil if the cluster does not use Kyber public keys.
+func (m ClusterMembers) VerificationRoster() *Roster {
+	if m.PublicKeys == nil {
+		return nil
+	}
+	if m.Roster != nil {
+		return m.Roster
 	}
-	return pks
+	var pks []string
+	for _, pk := range m.PublicKeys {
+		pks = append(pks, base64.StdEncoding.EncodeToString(pk[:]))
+	}
+	return RosterOfPublicKeys(pks)
 }
 
 func (c *ClusterConfig) GetSecretKey() []byte {
@@ -257,14 +544,27 @@ func (c *ClusterConfig) GetSecretKey() []byte {
 	return raw
 }
 
+// In hybrid mode, the Cluster Session Key established by Kyber-GAKE is combined with the QKD key.
+func (c *ClusterConfig) IsHybrid() bool {
+	return c.Crypto.IsHybrid()
+}
+
+// Kyber-GAKE is used when no crypto source is configured, or in kyber and hybrid modes.
+func (c *ClusterConfig) UsesKyber() bool {
+	return !c.Crypto.IsSet() || c.Crypto.UsesKyber()
+}
+
 func (c *ClusterConfig) IsClusterQKDPath() bool {
-	return strings.HasPrefix(strings.ToLower(c.Crypto), "path ")
+	return c.Crypto.UsesPSK()
 }
 
 func (c *ClusterConfig) ClusterQKDKeyFromFile() ([2 * gake.SsLen]byte, error) {
 	var key [2 * gake.SsLen]byte
-	raw := openAndDecodeKey(strings.TrimSpace(c.Crypto[5:]), 2*gake.SsLen)
-	copy(key[:], raw)
+	resolved, err := Resolver.Resolve(c.Crypto, QKDLinkCluster.KeySize())
+	if err != nil {
+		return key, err
+	}
+	copy(key[:], resolved.PSK)
 	return key, nil
 }
 
@@ -276,11 +576,7 @@ func (c *ClusterConfig) HasQKDUrl() bool {
 	if c == nil {
 		return false
 	}
-	return strings.HasPrefix(strings.ToLower(c.Crypto), "url ")
-}
-
-func (c *ClusterConfig) QKDUrl() string {
-	return strings.TrimSpace(c.Crypto[4:])
+	return c.Crypto.UsesETSI()
 }
 
 func (c *LeaderConfig) GetSecretKey() []byte {
@@ -288,56 +584,37 @@ func (c *LeaderConfig) GetSecretKey() []byte {
 	return raw
 }
 
-func (c *LeaderConfig) HasLeftQKDUrl() bool {
-	return strings.HasPrefix(strings.ToLower(c.LeftCrypto), "url ")
-}
-
-func (c *LeaderConfig) HasLeftQKDPath() bool {
-	return strings.HasPrefix(strings.ToLower(c.LeftCrypto), "path ")
-}
-
-func (c *LeaderConfig) HasRightQKDUrl() bool {
-	return strings.HasPrefix(strings.ToLower(c.RightCrypto), "url ")
-}
-
-func (c *LeaderConfig) HasRightQKDPath() bool {
-	return strings.HasPrefix(strings.ToLower(c.RightCrypto), "path ")
+func (c *BaseConfig) HasMailbox() bool {
+	return c.Leader != nil && c.Leader.MailboxSize > 0
 }
 
-func (c *LeaderConfig) LeftQKDUrl() string {
-	return strings.TrimSpace(c.LeftCrypto[4:])
-}
-
-func (c *LeaderConfig) RightQKDUrl() string {
-	return strings.TrimSpace(c.RightCrypto[4:])
+// Resolve the crypto source of the link with the left or right neighbor, exiting if its keys cannot be loaded.
+func (c *LeaderConfig) resolveLink(link QKDLink) ResolvedCrypto {
+	source := c.LeftCrypto
+	if link == QKDLinkRight {
+		source = c.RightCrypto
+	}
+	resolved, err := Resolver.Resolve(source, link.KeySize())
+	if err != nil {
+		ExitWithMsg(fmt.Sprintf("Error loading %s link keys: %v", link, err))
+	}
+	return resolved
 }
 
 func (c *LeaderConfig) LeftPublicKey() [gake.PkLen]byte {
-	raw := openAndDecodeKey(c.LeftCrypto, gake.PkLen)
-	var out [gake.PkLen]byte
-	copy(out[:], raw)
-	return out
+	return [gake.PkLen]byte(c.resolveLink(QKDLinkLeft).PublicKey)
 }
 
 func (c *LeaderConfig) RightPublicKey() [gake.PkLen]byte {
-	raw := openAndDecodeKey(c.RightCrypto, gake.PkLen)
-	var out [gake.PkLen]byte
-	copy(out[:], raw)
-	return out
+	return [gake.PkLen]byte(c.resolveLink(QKDLinkRight).PublicKey)
 }
 
 func (c *LeaderConfig) LeftQKDKey() [gake.SsLen]byte {
-	raw := openAndDecodeKey(strings.TrimSpace(c.LeftCrypto[5:]), gake.SsLen)
-	var out [gake.SsLen]byte
-	copy(out[:], raw)
-	return out
+	return [gake.SsLen]byte(c.resolveLink(QKDLinkLeft).PSK)
 }
 
 func (c *LeaderConfig) RightQKDKey() [gake.SsLen]byte {
-	raw := openAndDecodeKey(strings.TrimSpace(c.RightCrypto[5:]), gake.SsLen)
-	var out [gake.SsLen]byte
-	copy(out[:], raw)
-	return out
+	return [gake.SsLen]byte(c.resolveLink(QKDLinkRight).PSK)
 }
 
 func getPublicKeys(path string, n int) ([][gake.PkLen]byte, error) {
@@ -388,6 +665,13 @@ func loadJSONKey(path string) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot read key file %q: %w", path, err)
 	}
+	if isEncryptedKeyFile(data) {
+		key, err := unlockKeyFile(path, data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt key file %q: %w", path, err)
+		}
+		return slices.Clone(key), nil
+	}
 	var blob struct {
 		Key string `json:"key"`
 	}
@@ -1,9 +1,51 @@
 package util
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"pqgch/gake"
+
+	"golang.org/x/crypto/hkdf"
 )
 
+// Derive n bytes from the input keying material using HKDF with SHA-256 (RFC 5869).
+func hkdfSHA256(ikm, salt, info []byte, n int) []byte {
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, info), out); err != nil {
+		panic(err) // HKDF can only fail when asked for more than 255 blocks.
+	}
+	return out
+}
+
+// Derive n bytes for the purpose given by the label, which is used both as the salt and as the info.
+func deriveKey(ikm []byte, label string, n int) []byte {
+	return hkdfSHA256(ikm, []byte(label), []byte(label), n)
+}
+
+// Combine the 2-AKE key and the QKD key of a hybrid link between two leaders.
+// The result stays secret as long as at least one of the two keys does.
+// Both neighbors pass the keys in the same order, so they derive the same key.
+func CombineLinkKeys(akeKey, qkdKey [gake.SsLen]byte) [gake.SsLen]byte {
+	var out [gake.SsLen]byte
+	copy(out[:], deriveKey(append(akeKey[:], qkdKey[:]...), "pqgch-hybrid-link", gake.SsLen))
+	return out
+}
+
+// Combine the Cluster Session Key established by Kyber-GAKE with the QKD cluster key in hybrid mode.
+func CombineClusterKeys(gakeKey, qkdKey [2 * gake.SsLen]byte) [2 * gake.SsLen]byte {
+	var out [2 * gake.SsLen]byte
+	copy(out[:], deriveKey(append(gakeKey[:], qkdKey[:]...), "pqgch-hybrid-cluster", 2*gake.SsLen))
+	return out
+}
+
+// Compute the public identifier of the epoch the Main Session Key belongs to.
+// Every participant holding the key derives the same identifier, but it reveals nothing about the key.
+func EpochID(mainSessionKey [gake.SsLen]byte) string {
+	h := sha256.Sum256(append([]byte("pqgch-epoch"), mainSessionKey[:]...))
+	return hex.EncodeToString(h[:8])
+}
+
 // XOR all the Xs together. The result should be the zero byte array.
 // If it is not, abort the protocol.
 func CheckXs(xs [][gake.SsLen]byte, numParties int) bool {
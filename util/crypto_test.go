@@ -0,0 +1,124 @@
+package util
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"pqgch/gake"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid hex %q: %v", s, err)
+	}
+	return b
+}
+
+func hexRange(from, to int) string {
+	b := make([]byte, 0, to-from+1)
+	for i := from; i <= to; i++ {
+		b = append(b, byte(i))
+	}
+	return hex.EncodeToString(b)
+}
+
+// Test cases 1 to 3 of RFC 5869, appendix A, which use SHA-256.
+func TestHKDFSHA256RFC5869(t *testing.T) {
+	tests := []struct {
+		name, ikm, salt, info, okm string
+	}{
+		{
+			name: "basic",
+			ikm:  "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+			salt: "000102030405060708090a0b0c",
+			info: "f0f1f2f3f4f5f6f7f8f9",
+			okm:  "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865",
+		},
+		{
+			name: "longer inputs and outputs",
+			ikm:  hexRange(0x00, 0x4f),
+			salt: hexRange(0x60, 0xaf),
+			info: hexRange(0xb0, 0xff),
+			okm: "b11e398dc80327a1c8e7f78c596a49344f012eda2d4efad8a050cc4c19afa97c" +
+				"59045a99cac7827271cb41c65e590e09da3275600c2f09b8367793a9aca3db71" +
+				"cc30c58179ec3e87c14c01d5c1f3434f1d87",
+		},
+		{
+			name: "zero-length salt and info",
+			ikm:  "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+			okm:  "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := mustHex(t, tt.okm)
+			got := hkdfSHA256(mustHex(t, tt.ikm), mustHex(t, tt.salt), mustHex(t, tt.info), len(want))
+			if !bytes.Equal(got, want) {
+				t.Errorf("OKM = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func testKeys() (ake, qkd [gake.SsLen]byte, gakeKey, qkdCluster [2 * gake.SsLen]byte) {
+	for i := range ake {
+		ake[i], qkd[i] = byte(i), byte(0xa0+i)
+	}
+	for i := range gakeKey {
+		gakeKey[i], qkdCluster[i] = byte(i), byte(0x40+i)
+	}
+	return
+}
+
+// The combined keys must not change between versions, otherwise participants running different versions
+// cannot talk to each other.
+func TestCombineKeysKnownAnswers(t *testing.T) {
+	ake, qkd, gakeKey, qkdCluster := testKeys()
+
+	link := CombineLinkKeys(ake, qkd)
+	if want := mustHex(t, "ca9f350f486e7e5da936632826742dc48617c2bcf852aa386219eeafb0c63b83"); !bytes.Equal(link[:], want) {
+		t.Errorf("CombineLinkKeys() = %x, want %x", link, want)
+	}
+
+	cluster := CombineClusterKeys(gakeKey, qkdCluster)
+	want := mustHex(t, "8fc05495bbf6893f278a0b782555851a842d262d755ada2b4ab5e856a8615208"+
+		"daed4e25e7bee2201c34bead893cadea61182609a10fefb3dd8897f59affc41a")
+	if !bytes.Equal(cluster[:], want) {
+		t.Errorf("CombineClusterKeys() = %x, want %x", cluster, want)
+	}
+}
+
+// Changing either of the two keys has to change the combined key, so it stays secret as long as one of them does.
+func TestCombineKeysDependOnBothKeys(t *testing.T) {
+	ake, qkd, gakeKey, qkdCluster := testKeys()
+	link := CombineLinkKeys(ake, qkd)
+	cluster := CombineClusterKeys(gakeKey, qkdCluster)
+
+	otherAke, otherQKD := ake, qkd
+	otherAke[0] ^= 1
+	otherQKD[gake.SsLen-1] ^= 1
+	if CombineLinkKeys(otherAke, qkd) == link || CombineLinkKeys(ake, otherQKD) == link {
+		t.Error("CombineLinkKeys() ignores one of the keys")
+	}
+	if CombineLinkKeys(qkd, ake) == link {
+		t.Error("CombineLinkKeys() does not depend on the order of the keys")
+	}
+
+	otherGake, otherQKDCluster := gakeKey, qkdCluster
+	otherGake[0] ^= 1
+	otherQKDCluster[2*gake.SsLen-1] ^= 1
+	if CombineClusterKeys(otherGake, qkdCluster) == cluster || CombineClusterKeys(gakeKey, otherQKDCluster) == cluster {
+		t.Error("CombineClusterKeys() ignores one of the keys")
+	}
+
+	// The labels separate the two purposes, even for the same input.
+	var linkAsCluster [2 * gake.SsLen]byte
+	copy(linkAsCluster[:], deriveKey(append(ake[:], qkd[:]...), "pqgch-hybrid-cluster", 2*gake.SsLen))
+	if bytes.Equal(linkAsCluster[:gake.SsLen], link[:]) {
+		t.Error("the link and cluster labels derive the same key")
+	}
+}
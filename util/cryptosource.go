@@ -0,0 +1,240 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"pqgch/gake"
+	"strings"
+)
+
+// Kind of the source of a cluster or link key.
+type CryptoKind string
+
+const (
+	CryptoKyber  CryptoKind = "kyber"    // Kyber-GAKE in the cluster, Kyber 2-AKE between leaders.
+	CryptoQKD    CryptoKind = "qkd-etsi" // QKD keys requested from a KME through the ETSI API.
+	CryptoPSK    CryptoKind = "psk"      // Pre-shared key read from a file, for example to simulate QKD.
+	CryptoHybrid CryptoKind = "hybrid"   // Kyber combined with QKD keys from a KME or a pre-shared key.
+)
+
+// CryptoSource describes where the key of the cluster or of a link between leaders comes from.
+// In the configuration it is an object with the kind and its settings, for example
+// {"kind": "qkd-etsi", "url": "http://localhost:8080/etsi/", "saeId": "SAE_B"}.
+// The legacy string form ("<public key file>", "url <URL>", "path <file>" and their "hybrid " variants) is still accepted.
+type CryptoSource struct {
+	Kind      CryptoKind `json:"kind"`
+	PublicKey string     `json:"publicKey,omitempty"` // Kyber KEM public key file of the neighboring leader, links only.
+	URL       string     `json:"url,omitempty"`       // ETSI API endpoint of the KME.
+	SAEID     string     `json:"saeId,omitempty"`     // SAE ID of the other side, appended to the URL.
+	Path      string     `json:"path,omitempty"`      // File with the pre-shared key.
+}
+
+func (s *CryptoSource) UnmarshalJSON(data []byte) error {
+	var legacy string
+	if err := json.Unmarshal(data, &legacy); err == nil {
+		source, err := parseLegacyCrypto(legacy)
+		if err != nil {
+			return err
+		}
+		*s = source
+		return nil
+	}
+
+	// Decode into a type without this method, so we do not recurse.
+	type object CryptoSource
+	var source object
+	if err := json.Unmarshal(data, &source); err != nil {
+		return err
+	}
+	*s = CryptoSource(source)
+	s.Kind = CryptoKind(strings.ToLower(strings.TrimSpace(string(s.Kind))))
+	return nil
+}
+
+// Parse the legacy string form. It is one of:
+//   - <public key file>
+//   - url <URL>
+//   - path <QKD key file>
+//   - hybrid url <URL> or hybrid path <QKD key file>, in the cluster
+//   - hybrid <public key file> url <URL> or hybrid <public key file> path <QKD key file>, between leaders
+//
+// Paths may contain spaces. In the hybrid form the public key file is separated from the rest only by
+// " url " or " path ", so a value containing more than one of them is ambiguous and rejected.
+func parseLegacyCrypto(value string) (CryptoSource, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return CryptoSource{}, nil
+	}
+
+	kind, rest, _ := strings.Cut(value, " ")
+	rest = strings.TrimSpace(rest)
+	switch strings.ToLower(kind) {
+	case "url":
+		return CryptoSource{Kind: CryptoQKD, URL: rest}, nil
+	case "path":
+		return CryptoSource{Kind: CryptoPSK, Path: rest}, nil
+	case "hybrid":
+		source := CryptoSource{Kind: CryptoHybrid}
+		// Prefix a space, so the separator is also found at the start when there is no public key.
+		rest = " " + rest
+		separators := legacySeparators(rest)
+		switch len(separators) {
+		case 0:
+			source.PublicKey = strings.TrimSpace(rest)
+		case 1:
+			at := separators[0]
+			source.PublicKey = strings.TrimSpace(rest[:at])
+			qkd, _ := parseLegacyCrypto(rest[at:])
+			source.URL, source.Path = qkd.URL, qkd.Path
+		default:
+			return CryptoSource{}, fmt.Errorf("ambiguous crypto %q: more than one \"url\" or \"path\", use the object form", value)
+		}
+		return source, nil
+	default:
+		return CryptoSource{Kind: CryptoKyber, PublicKey: value}, nil
+	}
+}
+
+// Find the positions of the " url " and " path " separators of the hybrid legacy form, ignoring case.
+func legacySeparators(value string) []int {
+	var found []int
+	for i := range len(value) {
+		for _, separator := range []string{" url ", " path "} {
+			if len(value)-i >= len(separator) && strings.EqualFold(value[i:i+len(separator)], separator) {
+				found = append(found, i)
+			}
+		}
+	}
+	return found
+}
+
+// Report whether the source is configured at all.
+func (s *CryptoSource) IsSet() bool {
+	return s != nil && *s != CryptoSource{}
+}
+
+// Kyber is used, either alone or in hybrid mode.
+func (s *CryptoSource) UsesKyber() bool {
+	return s.IsSet() && (s.Kind == CryptoKyber || s.Kind == CryptoHybrid)
+}
+
+// QKD keys are used, either alone or in hybrid mode.
+func (s *CryptoSource) UsesQKD() bool {
+	return s.UsesETSI() || s.UsesPSK()
+}
+
+// QKD keys are requested from a KME.
+func (s *CryptoSource) UsesETSI() bool {
+	return s.IsSet() && (s.Kind == CryptoQKD || s.Kind == CryptoHybrid) && s.URL != ""
+}
+
+// QKD key is pre-shared in a file.
+func (s *CryptoSource) UsesPSK() bool {
+	return s.IsSet() && (s.Kind == CryptoPSK || s.Kind == CryptoHybrid) && s.Path != ""
+}
+
+func (s *CryptoSource) IsHybrid() bool {
+	return s.IsSet() && s.Kind == CryptoHybrid
+}
+
+// Check that the source has exactly the settings its kind needs.
+// In the cluster, Kyber keys are configured by publicKeys and secretKey, so the source has no public key.
+func (s *CryptoSource) validate(name string, cluster bool) []string {
+	var errs []string
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Sprintf("%s: "+format, append([]any{name}, args...)...))
+	}
+
+	wantPK := !cluster && (s.Kind == CryptoKyber || s.Kind == CryptoHybrid)
+	switch {
+	case wantPK && s.PublicKey == "":
+		fail("%s requires publicKey", s.Kind)
+	case !wantPK && s.PublicKey != "":
+		fail("publicKey is not allowed here")
+	}
+
+	switch s.Kind {
+	case CryptoKyber:
+		if s.URL != "" || s.Path != "" {
+			fail("kyber does not use url or path")
+		}
+	case CryptoQKD:
+		if s.URL == "" || s.Path != "" {
+			fail("qkd-etsi requires url and no path")
+		}
+	case CryptoPSK:
+		if s.Path == "" || s.URL != "" {
+			fail("psk requires path and no url")
+		}
+	case CryptoHybrid:
+		if (s.URL == "") == (s.Path == "") {
+			fail("hybrid requires either url or path")
+		}
+	case "":
+		fail("missing kind (must be kyber, qkd-etsi, psk or hybrid)")
+	default:
+		fail("unknown kind %q (must be kyber, qkd-etsi, psk or hybrid)", s.Kind)
+	}
+	if s.SAEID != "" && s.URL == "" {
+		fail("saeId requires url")
+	}
+
+	return errs
+}
+
+// Key material and endpoints of a crypto source.
+type ResolvedCrypto struct {
+	PublicKey []byte // Kyber KEM public key of the neighboring leader, nil if not used.
+	PSK       []byte // Pre-shared QKD key, nil if not used.
+	URL       string // ETSI API endpoint of the KME, empty if not used.
+	SAEID     string // SAE ID of the other side on the KME.
+}
+
+// CryptoResolver loads the key material a crypto source refers to.
+// pskSize is the size in bytes the pre-shared key must have.
+type CryptoResolver interface {
+	Resolve(source *CryptoSource, pskSize int) (ResolvedCrypto, error)
+}
+
+// Resolver used by the configuration. It reads the keys from the files named by the source.
+var Resolver CryptoResolver = fileResolver{}
+
+type fileResolver struct{}
+
+func (fileResolver) Resolve(source *CryptoSource, pskSize int) (ResolvedCrypto, error) {
+	var resolved ResolvedCrypto
+	if !source.IsSet() {
+		return resolved, nil
+	}
+
+	if source.PublicKey != "" {
+		pk, err := loadKeyOfSize(source.PublicKey, gake.PkLen)
+		if err != nil {
+			return resolved, err
+		}
+		resolved.PublicKey = pk
+	}
+	if source.UsesPSK() {
+		psk, err := loadKeyOfSize(source.Path, pskSize)
+		if err != nil {
+			return resolved, err
+		}
+		resolved.PSK = psk
+	}
+	if source.UsesETSI() {
+		resolved.URL = source.URL
+		resolved.SAEID = source.SAEID
+	}
+	return resolved, nil
+}
+
+func loadKeyOfSize(path string, size int) ([]byte, error) {
+	raw, err := loadJSONKey(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != size {
+		return nil, fmt.Errorf("key %q has wrong length: expected %d, got %d", path, size, len(raw))
+	}
+	return raw, nil
+}
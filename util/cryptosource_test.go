@@ -0,0 +1,74 @@
+package util
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseLegacyCrypto(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    CryptoSource
+		wantErr bool
+	}{
+		{"", CryptoSource{}, false},
+		{"right_pk.json", CryptoSource{Kind: CryptoKyber, PublicKey: "right_pk.json"}, false},
+		{"keys/my right pk.json", CryptoSource{Kind: CryptoKyber, PublicKey: "keys/my right pk.json"}, false},
+		{"url http://localhost:8080/etsi/", CryptoSource{Kind: CryptoQKD, URL: "http://localhost:8080/etsi/"}, false},
+		{"URL http://localhost:8080/etsi/", CryptoSource{Kind: CryptoQKD, URL: "http://localhost:8080/etsi/"}, false},
+		{"path psk.json", CryptoSource{Kind: CryptoPSK, Path: "psk.json"}, false},
+		{"path  keys/my psk.json ", CryptoSource{Kind: CryptoPSK, Path: "keys/my psk.json"}, false},
+		{"hybrid url http://kme/etsi/", CryptoSource{Kind: CryptoHybrid, URL: "http://kme/etsi/"}, false},
+		{"hybrid path psk.json", CryptoSource{Kind: CryptoHybrid, Path: "psk.json"}, false},
+		{"hybrid right_pk.json url http://kme/etsi/", CryptoSource{Kind: CryptoHybrid, PublicKey: "right_pk.json", URL: "http://kme/etsi/"}, false},
+		{"hybrid right_pk.json path psk.json", CryptoSource{Kind: CryptoHybrid, PublicKey: "right_pk.json", Path: "psk.json"}, false},
+		{"hybrid keys/right pk.json path keys/right psk.json", CryptoSource{Kind: CryptoHybrid, PublicKey: "keys/right pk.json", Path: "keys/right psk.json"}, false},
+		{"Hybrid right_pk.json PATH psk.json", CryptoSource{Kind: CryptoHybrid, PublicKey: "right_pk.json", Path: "psk.json"}, false},
+		{"hybrid right_pk.json", CryptoSource{Kind: CryptoHybrid, PublicKey: "right_pk.json"}, false},
+		{"hybrid right_pk.json path old path psk.json", CryptoSource{}, true},
+		{"hybrid right_pk.json url http://kme/etsi/ path psk.json", CryptoSource{}, true},
+		{"hybrid path keys/url psk.json", CryptoSource{Kind: CryptoHybrid, Path: "keys/url psk.json"}, false},
+		{"hybrid path my url file.json", CryptoSource{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseLegacyCrypto(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLegacyCrypto() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseLegacyCrypto() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCryptoSourceUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    CryptoSource
+		wantErr bool
+	}{
+		{"object", `{"kind": "qkd-etsi", "url": "http://kme/etsi/", "saeId": "SAE_B"}`, CryptoSource{Kind: CryptoQKD, URL: "http://kme/etsi/", SAEID: "SAE_B"}, false},
+		{"kind is normalized", `{"kind": " PSK ", "path": "psk.json"}`, CryptoSource{Kind: CryptoPSK, Path: "psk.json"}, false},
+		{"legacy string", `"hybrid right_pk.json url http://kme/etsi/"`, CryptoSource{Kind: CryptoHybrid, PublicKey: "right_pk.json", URL: "http://kme/etsi/"}, false},
+		{"ambiguous legacy string", `"hybrid pk.json path a path b"`, CryptoSource{}, true},
+		{"wrong type", `42`, CryptoSource{}, true},
+		{"unknown field type", `{"kind": 1}`, CryptoSource{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got CryptoSource
+			err := json.Unmarshal([]byte(tt.json), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Unmarshal() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
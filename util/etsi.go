@@ -1,99 +1,593 @@
 package util
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"pqgch/gake"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// Key as delivered by the ETSI GS QKD 014 API.
 type Key struct {
-	KeyID string `json:"key_ID"`
-	Key   string `json:"key"`
+	KeyID          string          `json:"key_ID"`
+	KeyIDExtension json.RawMessage `json:"key_ID_extension,omitempty"`
+	Key            string          `json:"key"`
+	KeyExtension   json.RawMessage `json:"key_extension,omitempty"`
 }
 
 type KeyContainer struct {
-	Keys []Key `json:"keys"`
+	Keys                  []Key           `json:"keys"`
+	KeyContainerExtension json.RawMessage `json:"key_container_extension,omitempty"`
 }
 
-func getKey(endpoint string) (string, string, error) {
-	resp, err := http.Get(endpoint + "/enc_keys?number=1&size=" + strconv.Itoa(gake.SsLen*8*2))
-	if err != nil {
-		return "", "", fmt.Errorf("failed to call ETSI API: %w", err)
+// Status of the key stream between us and the slave SAE, as returned by the status endpoint.
+type KeyStatus struct {
+	SourceKMEID      string          `json:"source_KME_ID"`
+	TargetKMEID      string          `json:"target_KME_ID"`
+	MasterSAEID      string          `json:"master_SAE_ID"`
+	SlaveSAEID       string          `json:"slave_SAE_ID"`
+	KeySize          int             `json:"key_size"`            // Default key size in bits.
+	StoredKeyCount   int             `json:"stored_key_count"`    // Number of keys ready to be delivered.
+	MaxKeyCount      int             `json:"max_key_count"`       // Maximal number of keys the KME can store.
+	MaxKeyPerRequest int             `json:"max_key_per_request"` // Maximal number of keys in one request.
+	MaxKeySize       int             `json:"max_key_size"`
+	MinKeySize       int             `json:"min_key_size"`
+	MaxSAEIDCount    int             `json:"max_SAE_ID_count"` // Maximal number of additional slave SAE IDs.
+	StatusExtension  json.RawMessage `json:"status_extension,omitempty"`
+}
+
+// Body of the Get key request.
+type KeyRequest struct {
+	Number                int               `json:"number,omitempty"`
+	Size                  int               `json:"size,omitempty"` // Key size in bits.
+	AdditionalSlaveSAEIDs []string          `json:"additional_slave_SAE_IDs,omitempty"`
+	ExtensionMandatory    []json.RawMessage `json:"extension_mandatory,omitempty"`
+	ExtensionOptional     []json.RawMessage `json:"extension_optional,omitempty"`
+}
+
+// Needs a POST request, since it cannot be expressed with query parameters.
+func (r KeyRequest) needsBody() bool {
+	return len(r.AdditionalSlaveSAEIDs) > 0 || len(r.ExtensionMandatory) > 0 || len(r.ExtensionOptional) > 0
+}
+
+type KeyID struct {
+	KeyID          string          `json:"key_ID"`
+	KeyIDExtension json.RawMessage `json:"key_ID_extension,omitempty"`
+}
+
+// Body of the Get key with key IDs request.
+type KeyIDs struct {
+	KeyIDs          []KeyID         `json:"key_IDs"`
+	KeyIDsExtension json.RawMessage `json:"key_IDs_extension,omitempty"`
+}
+
+// Errors corresponding to the HTTP status codes defined by ETSI GS QKD 014.
+// Use errors.Is on the errors returned by ETSIClient to find out which one occurred.
+var (
+	ErrETSIBadRequest   = errors.New("bad request format")
+	ErrETSIUnauthorized = errors.New("unauthorized")
+	ErrETSIUnavailable  = errors.New("error on server side")
+)
+
+// ETSIError is the error response of the ETSI API.
+type ETSIError struct {
+	StatusCode int
+	Message    string
+	Details    []json.RawMessage
+}
+
+func (e *ETSIError) Error() string {
+	msg := fmt.Sprintf("ETSI API returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	for _, detail := range e.Details {
+		msg += " " + string(detail)
 	}
+	return msg
+}
 
-	key, id, err := parseResponse(resp)
+func (e *ETSIError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return ErrETSIBadRequest
+	case http.StatusUnauthorized:
+		return ErrETSIUnauthorized
+	case http.StatusServiceUnavailable:
+		return ErrETSIUnavailable
+	default:
+		return nil
+	}
+}
 
-	return key, id, err
+// ETSIClient talks to the key management entity (KME) through the ETSI GS QKD 014 API.
+// The endpoint is the URL of the key stream up to and including the SAE ID,
+// for example https://kme/api/v1/keys/SAE_ID.
+type ETSIClient struct {
+	endpoint   string
+	httpClient *http.Client
+	saeID      string      // Our SAE ID, sent in the X-SAE-ID header of the mock KME. Empty for real KMEs.
+	retry      RetryPolicy // Used by RequestKey and RequestKeyByID.
+	keySize    int         // Size in bytes of the keys requested by RequestKey, depends on what the keys are used for.
 }
 
-// Make a request for the key with keyID to the ETSI QKD API.
-func getKeyByID(endpoint, keyID string) (string, string, error) {
-	resp, err := http.Get(endpoint + "/dec_keys?key_ID=" + keyID)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to call ETSI API: %w", err)
+func NewETSIClient(endpoint string, httpClient *http.Client) *ETSIClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
 	}
+	return &ETSIClient{
+		endpoint:   strings.TrimRight(endpoint, "/"),
+		httpClient: httpClient,
+		retry:      DefaultRetryPolicy,
+		keySize:    QKDLinkCluster.KeySize(),
+	}
+}
+
+// RetryPolicy bounds how long we keep asking the KME for a key.
+type RetryPolicy struct {
+	MaxAttempts    int           // Number of attempts before giving up, 0 means no limit.
+	Timeout        time.Duration // Timeout of a single attempt.
+	InitialBackoff time.Duration // Delay after the first failed attempt, doubled after every further one.
+	MaxBackoff     time.Duration // Upper bound of the delay between attempts.
+	Deadline       time.Duration // Upper bound of the time the protocol waits for a key, 0 means no limit.
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    10,
+	Timeout:        10 * time.Second,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	Deadline:       5 * time.Minute,
+}
+
+// Context bounding the time the protocol waits for a key, including all the attempts, by the deadline of the policy.
+func (p RetryPolicy) KeyContext() (context.Context, context.CancelFunc) {
+	if p.Deadline <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), p.Deadline)
+}
+
+// Run the attempt until it succeeds, the attempts are exhausted or the context is cancelled.
+// Between the attempts we wait with exponential backoff and jitter, so clients do not retry in lockstep.
+// Only transient errors are retried, see retryable. The final error is returned to the caller.
+func (p RetryPolicy) run(ctx context.Context, what string, attempt func(ctx context.Context) error) error {
+	backoff := p.InitialBackoff
+	for i := 1; ; i++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if p.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, p.Timeout)
+		}
+		err := attempt(attemptCtx)
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !retryable(err) {
+			return err
+		}
+		if p.MaxAttempts > 0 && i >= p.MaxAttempts {
+			return fmt.Errorf("%s failed after %d attempts: %w", what, i, err)
+		}
+
+		delay := backoff/2 + rand.N(backoff/2+1)
+		LogError(fmt.Sprintf("%s: %v. Retrying in %s...", what, err, delay.Round(time.Millisecond)))
 
-	key, id, err := parseResponse(resp)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 
-	return key, id, err
+		backoff = min(2*backoff, p.MaxBackoff)
+	}
 }
 
-func parseResponse(resp *http.Response) (string, string, error) {
+// Decide whether repeating the request may help: network errors, 5xx responses and a KME without keys ready
+// may go away, while 4xx responses, such as a bad request or a missing authorization, will be returned again.
+func retryable(err error) bool {
+	var etsiErr *ETSIError
+	if errors.As(err, &etsiErr) {
+		return etsiErr.StatusCode >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.Is(err, ErrKMEExhausted) || errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Get the status of the key stream.
+func (c *ETSIClient) Status(ctx context.Context) (KeyStatus, error) {
+	var status KeyStatus
+	err := c.do(ctx, http.MethodGet, "status", nil, nil, &status)
+	return status, err
+}
+
+// Get new keys. The keys are delivered to the slave SAE (and the additional slave SAEs) when they ask for them by ID.
+// Requests which cannot be expressed using query parameters are sent as POST.
+func (c *ETSIClient) GetKeys(ctx context.Context, req KeyRequest) ([]Key, error) {
+	var container KeyContainer
+	var err error
+	if req.needsBody() {
+		err = c.do(ctx, http.MethodPost, "enc_keys", nil, req, &container)
+	} else {
+		query := url.Values{}
+		if req.Number > 0 {
+			query.Set("number", strconv.Itoa(req.Number))
+		}
+		if req.Size > 0 {
+			query.Set("size", strconv.Itoa(req.Size))
+		}
+		err = c.do(ctx, http.MethodGet, "enc_keys", query, nil, &container)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if req.Number > 0 && len(container.Keys) != req.Number {
+		return nil, fmt.Errorf("ETSI API returned %d keys, requested %d", len(container.Keys), req.Number)
+	}
+	return container.Keys, nil
+}
+
+// Get the keys with the given IDs. A single ID is requested using GET, multiple IDs using POST.
+func (c *ETSIClient) GetKeysWithIDs(ctx context.Context, ids KeyIDs) ([]Key, error) {
+	var container KeyContainer
+	var err error
+	if len(ids.KeyIDs) == 1 && ids.KeyIDs[0].KeyIDExtension == nil && ids.KeyIDsExtension == nil {
+		query := url.Values{"key_ID": {ids.KeyIDs[0].KeyID}}
+		err = c.do(ctx, http.MethodGet, "dec_keys", query, nil, &container)
+	} else {
+		err = c.do(ctx, http.MethodPost, "dec_keys", nil, ids, &container)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(container.Keys) != len(ids.KeyIDs) {
+		return nil, fmt.Errorf("ETSI API returned %d keys, requested %d", len(container.Keys), len(ids.KeyIDs))
+	}
+	return container.Keys, nil
+}
+
+func (c *ETSIClient) do(ctx context.Context, method, action string, query url.Values, body, out any) error {
+	target := c.endpoint + "/" + action
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode ETSI API request: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create ETSI API request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.saeID != "" {
+		req.Header.Set("X-SAE-ID", c.saeID)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call ETSI API: %w", err)
+	}
 	defer resp.Body.Close()
 
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read ETSI API response: %w", err)
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		return "", "", fmt.Errorf("ETSI API returned non-OK status: %s", resp.Status)
+		etsiErr := &ETSIError{StatusCode: resp.StatusCode}
+		var blob struct {
+			Message string            `json:"message"`
+			Details []json.RawMessage `json:"details"`
+		}
+		if json.Unmarshal(data, &blob) == nil {
+			etsiErr.Message = blob.Message
+			etsiErr.Details = blob.Details
+		} else {
+			etsiErr.Message = strings.TrimSpace(string(data))
+		}
+		return etsiErr
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to parse ETSI API response: %w", err)
+	}
+	return nil
+}
+
+// Settings of the link, or an empty configuration if there are none.
+func (c *QKDConfig) link(link QKDLink) QKDLinkConfig {
+	var lc *QKDLinkConfig
+	if c != nil {
+		switch link {
+		case QKDLinkCluster:
+			lc = c.Cluster
+		case QKDLinkLeft:
+			lc = c.Left
+		case QKDLinkRight:
+			lc = c.Right
+		}
+	}
+	if lc == nil {
+		return QKDLinkConfig{}
+	}
+	return *lc
+}
+
+// Build the TLS configuration for the link, preferring the credentials of the link over the top-level ones.
+// Returns nil if no TLS settings are configured, in which case the defaults of the HTTP client are used.
+func (c *QKDConfig) tlsConfig(link QKDLink) (*tls.Config, error) {
+	if c == nil {
+		return nil, nil
+	}
+	lc := c.link(link)
+	caCert, clientCert, clientKey := c.CACert, c.ClientCert, c.ClientKey
+	if lc.CACert != "" {
+		caCert = lc.CACert
+	}
+	if lc.ClientCert != "" || lc.ClientKey != "" {
+		clientCert, clientKey = lc.ClientCert, lc.ClientKey
+	}
+	if caCert == "" && clientCert == "" && clientKey == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %q", caCert)
+		}
+		config.RootCAs = pool
+	}
+
+	if clientCert != "" || clientKey != "" {
+		if clientCert == "" || clientKey == "" {
+			return nil, errors.New("clientCert and clientKey must be provided together")
+		}
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// Get the SAE IDs of the cluster members that have to receive the key in addition to the slave SAE in the URL,
+// i.e. the member SAE IDs of the cluster link except the peerSaeId and our own.
+func (c *BaseConfig) AdditionalSlaveSAEIDs() []string {
+	own, peer := c.QKDSAEIDs(QKDLinkCluster)
+	var additional []string
+	for _, id := range c.QKD.link(QKDLinkCluster).MemberSAEIDs {
+		if id != peer && id != own {
+			additional = append(additional, id)
+		}
+	}
+	return additional
+}
+
+// Get the ETSI endpoint for the link, i.e. the configured URL followed by the SAE ID of the other side, if set.
+func (c *BaseConfig) qkdEndpoint(link QKDLink) string {
+	endpoint := c.linkSource(link).URL
+	if _, peer := c.QKDSAEIDs(link); peer != "" {
+		endpoint = strings.TrimRight(endpoint, "/") + "/" + peer
+	}
+	return endpoint
+}
+
+// Get our SAE ID and the SAE ID of the other side of the link, empty if they are not configured.
+// The SAE ID of the other side from the qkd section takes precedence over the one of the crypto source.
+func (c *BaseConfig) QKDSAEIDs(link QKDLink) (own, peer string) {
+	lc := c.QKD.link(link)
+	peer = lc.PeerSAEID
+	if source := c.linkSource(link); peer == "" && source != nil {
+		peer = source.SAEID
+	}
+	return lc.SAEID, peer
+}
+
+func (c *BaseConfig) linkSource(link QKDLink) *CryptoSource {
+	switch {
+	case link == QKDLinkCluster && c.Cluster != nil:
+		return c.Cluster.Crypto
+	case link == QKDLinkLeft && c.Leader != nil:
+		return c.Leader.LeftCrypto
+	case link == QKDLinkRight && c.Leader != nil:
+		return c.Leader.RightCrypto
+	default:
+		return nil
+	}
+}
+
+// Check that every link on which we name our SAE to the KME also names the SAE on the other side.
+// It is never guessed: a member would otherwise ask for the cluster key in the key stream of another member
+// instead of the one of the leader who requested it. The SAE ID of the other side may be set both in the qkd
+// section and in the crypto source, but not to different values.
+func (c *BaseConfig) validateSAEIDs() []string {
+	var errs []string
+	for _, link := range []QKDLink{QKDLinkCluster, QKDLinkLeft, QKDLinkRight} {
+		lc := c.QKD.link(link)
+		if source := c.linkSource(link); source != nil && source.SAEID != "" && lc.PeerSAEID != "" && source.SAEID != lc.PeerSAEID {
+			errs = append(errs, fmt.Sprintf("qkd: %s link: peerSaeId %q differs from the saeId %q of the crypto source, set only one of them", link, lc.PeerSAEID, source.SAEID))
+			continue
+		}
+		if source := c.linkSource(link); source == nil || !source.UsesETSI() || (lc.SAEID == "" && len(lc.MemberSAEIDs) == 0) {
+			continue
+		}
+		if _, peer := c.QKDSAEIDs(link); peer == "" {
+			errs = append(errs, fmt.Sprintf("qkd: %s link: missing the SAE ID of the other side, set peerSaeId (or saeId of the crypto source)", link))
+		}
+	}
+	return errs
+}
+
+// Create the ETSI client for the link, using the HTTPS credentials from the qkd section of the configuration.
+func (c *BaseConfig) QKDClient(link QKDLink) *ETSIClient {
+	tlsConfig, err := c.QKD.tlsConfig(link)
+	if err != nil {
+		ExitWithMsg(fmt.Sprintf("failed to set up TLS for the %s QKD link: %v", link, err))
+	}
+
+	httpClient := http.DefaultClient
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		httpClient = &http.Client{Transport: transport}
+	}
+
+	client := NewETSIClient(c.qkdEndpoint(link), httpClient)
+	if c.QKD != nil && c.QKD.MockSAEIDHeader {
+		client.saeID = c.QKD.link(link).SAEID
+	}
+	client.retry = c.QKD.RetryPolicy()
+	client.keySize = link.KeySize()
+	return client
+}
+
+// Size in bytes of the QKD keys used on the link.
+// The cluster key becomes the Cluster Session Key, the keys of the links between leaders are used as the 2-AKE keys.
+func (l QKDLink) KeySize() int {
+	if l == QKDLinkCluster {
+		return 2 * gake.SsLen
+	}
+	return gake.SsLen
+}
+
+// Decode the key delivered by the KME and check that it has exactly the expected size and does not look degenerate.
+func DecodeQKDKey(encoded string, size int) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to read ETSI API response: %v", err)
+		return nil, fmt.Errorf("QKD key is not valid base64: %w", err)
+	}
+	if len(key) != size {
+		clear(key)
+		return nil, fmt.Errorf("QKD key length mismatch: expected %d bytes, got %d", size, len(key))
+	}
+	if err := checkKeyEntropy(key); err != nil {
+		clear(key)
+		return nil, err
+	}
+	return key, nil
+}
+
+// Sanity check of the key material. It cannot prove the key is random, but it catches
+// keys a misconfigured or broken KME delivers, such as zeros, a repeated byte or a repeated half.
+// A random key of 32 bytes has about 30 distinct bytes, so requiring a quarter of its length is safe.
+func checkKeyEntropy(key []byte) error {
+	var seen [256]bool
+	distinct := 0
+	for _, b := range key {
+		if !seen[b] {
+			seen[b] = true
+			distinct++
+		}
 	}
+	if distinct < max(2, len(key)/4) {
+		return fmt.Errorf("QKD key has only %d distinct bytes out of %d and is unlikely to be random", distinct, len(key))
+	}
+	half := len(key) / 2
+	if bytes.Equal(key[:half], key[half:2*half]) {
+		return errors.New("QKD key consists of a repeated pattern and is unlikely to be random")
+	}
+	return nil
+}
 
-	var response KeyContainer
-	if err := json.Unmarshal(body, &response); err != nil {
-		return "", "", fmt.Errorf("failed to parse ETSI API response: %v", err)
+func getKey(ctx context.Context, client *ETSIClient, additionalSlaves []string) (string, string, error) {
+	keys, err := client.GetKeys(ctx, KeyRequest{
+		Number:                1,
+		Size:                  client.keySize * 8,
+		AdditionalSlaveSAEIDs: additionalSlaves,
+	})
+	if err != nil {
+		return "", "", err
 	}
 
-	if len(response.Keys) != 1 {
-		return "", "", fmt.Errorf("invalid length of keys array")
+	return keys[0].Key, keys[0].KeyID, nil
+}
+
+// Make a request for the key with keyID to the ETSI QKD API.
+func getKeyByID(ctx context.Context, client *ETSIClient, keyID string) (string, string, error) {
+	keys, err := client.GetKeysWithIDs(ctx, KeyIDs{KeyIDs: []KeyID{{KeyID: keyID}}})
+	if err != nil {
+		return "", "", err
 	}
 
-	return response.Keys[0].Key, response.Keys[0].KeyID, nil
+	return keys[0].Key, keys[0].KeyID, nil
 }
 
-func RequestKey(url string) (string, string) {
+// Request a new key. If additional slave SAE IDs are given, the KME delivers the key to all of them.
+// Failed attempts are retried according to the retry policy of the client.
+// The key is checked to have the size requested for the purpose of the link.
+func RequestKey(ctx context.Context, client *ETSIClient, additionalSlaves []string) (string, string, error) {
 	var key, keyID string
-	for {
+	err := client.retry.run(ctx, "Requesting QKD key", func(ctx context.Context) error {
 		var err error
-		key, keyID, err = getKey(url)
-		if err != nil {
-			LogError(fmt.Sprintf("Requesting QKD key: %v. Retrying...", err))
-			time.Sleep(2 * time.Second)
-			continue
-		}
-		break
+		key, keyID, err = getKey(ctx, client, additionalSlaves)
+		return err
+	})
+	if err != nil {
+		return "", "", err
 	}
 
-	return key, keyID
+	decoded, err := DecodeQKDKey(key, client.keySize)
+	if err != nil {
+		return "", "", fmt.Errorf("KME delivered an unusable key %s: %w", keyID, err)
+	}
+	clear(decoded)
+	return key, keyID, nil
 }
 
-func RequestKeyByID(url, id string) string {
+// Request the key with the given ID, retrying failed attempts according to the retry policy of the client.
+// The key is checked to have the size used for the purpose of the link. The caller erases it once it is used.
+func RequestKeyByID(ctx context.Context, client *ETSIClient, id string) ([]byte, error) {
 	var key string
-	for {
+	err := client.retry.run(ctx, "Requesting QKD key by ID", func(ctx context.Context) error {
 		var err error
-		key, _, err = getKeyByID(url, id)
-		if err != nil {
-			LogError(fmt.Sprintf("Requesting QKD key by ID: %v. Retrying...", err))
-			time.Sleep(2 * time.Second)
-			continue
-		}
-		break
+		key, _, err = getKeyByID(ctx, client, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return key
+	decoded, err := DecodeQKDKey(key, client.keySize)
+	if err != nil {
+		return nil, fmt.Errorf("KME delivered an unusable key %s: %w", id, err)
+	}
+	return decoded, nil
 }
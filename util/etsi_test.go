@@ -0,0 +1,150 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func etsiClusterConfig(source CryptoSource, link QKDLinkConfig) BaseConfig {
+	return BaseConfig{
+		Cluster: &ClusterConfig{Crypto: &source},
+		QKD:     &QKDConfig{Cluster: &link},
+	}
+}
+
+func TestValidateSAEIDs(t *testing.T) {
+	etsi := CryptoSource{Kind: CryptoQKD, URL: "http://kme/etsi"}
+	withPeer := etsi
+	withPeer.SAEID = "SAE_LEADER"
+
+	tests := []struct {
+		name    string
+		config  BaseConfig
+		wantErr bool
+	}{
+		{"member without peer", etsiClusterConfig(etsi, QKDLinkConfig{SAEID: "SAE_M1"}), true},
+		{"member with peerSaeId", etsiClusterConfig(etsi, QKDLinkConfig{SAEID: "SAE_M1", PeerSAEID: "SAE_LEADER"}), false},
+		{"member with saeId of the source", etsiClusterConfig(withPeer, QKDLinkConfig{SAEID: "SAE_M1"}), false},
+		{"member with the same peer in both", etsiClusterConfig(withPeer, QKDLinkConfig{SAEID: "SAE_M1", PeerSAEID: "SAE_LEADER"}), false},
+		{"member with different peers", etsiClusterConfig(withPeer, QKDLinkConfig{SAEID: "SAE_M1", PeerSAEID: "SAE_M2"}), true},
+		{"leader with members but without peer", etsiClusterConfig(etsi, QKDLinkConfig{MemberSAEIDs: []string{"SAE_M1", "SAE_M2"}}), true},
+		{"leader with members and peer", etsiClusterConfig(etsi, QKDLinkConfig{PeerSAEID: "SAE_M1", MemberSAEIDs: []string{"SAE_M1", "SAE_M2"}}), false},
+		{"legacy URL without SAE IDs", etsiClusterConfig(etsi, QKDLinkConfig{}), false},
+		{"pre-shared key", etsiClusterConfig(CryptoSource{Kind: CryptoPSK, Path: "psk.json"}, QKDLinkConfig{SAEID: "SAE_M1"}), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.config.validateSAEIDs()
+			if (len(errs) > 0) != tt.wantErr {
+				t.Errorf("validateSAEIDs() = %v, wantErr %v", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAdditionalSlaveSAEIDs(t *testing.T) {
+	config := etsiClusterConfig(CryptoSource{Kind: CryptoQKD, URL: "http://kme/etsi"}, QKDLinkConfig{
+		SAEID:        "SAE_LEADER",
+		PeerSAEID:    "SAE_M2",
+		MemberSAEIDs: []string{"SAE_M1", "SAE_M2", "SAE_LEADER", "SAE_M3"},
+	})
+
+	got := config.AdditionalSlaveSAEIDs()
+	if want := []string{"SAE_M1", "SAE_M3"}; !slices.Equal(got, want) {
+		t.Errorf("AdditionalSlaveSAEIDs() = %v, want %v", got, want)
+	}
+	if endpoint := config.qkdEndpoint(QKDLinkCluster); endpoint != "http://kme/etsi/SAE_M2" {
+		t.Errorf("qkdEndpoint() = %q, want the URL of the peerSaeId", endpoint)
+	}
+}
+
+func TestRetryPolicyRetriesOnlyTransientErrors(t *testing.T) {
+	tests := []struct {
+		status       int
+		wantAttempts int32
+	}{
+		{http.StatusBadRequest, 1},
+		{http.StatusUnauthorized, 1},
+		{http.StatusNotFound, 1},
+		{http.StatusInternalServerError, 3},
+		{http.StatusServiceUnavailable, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts.Add(1)
+				http.Error(w, `{"message": "failing"}`, tt.status)
+			}))
+			defer server.Close()
+
+			client := NewETSIClient(server.URL, nil)
+			client.retry = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+			if _, _, err := RequestKey(context.Background(), client, nil); err == nil {
+				t.Fatal("RequestKey() succeeded against a failing KME")
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryableNetworkError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	client := NewETSIClient(server.URL, nil)
+	_, err := client.Status(context.Background())
+	if err == nil || !retryable(err) {
+		t.Errorf("error of an unreachable KME %v is not retryable", err)
+	}
+}
+
+func TestDecodeQKDKey(t *testing.T) {
+	const size = 32
+	random := make([]byte, size)
+	rand.Read(random)
+	repeatedHalf := append(bytes.Clone(random[:size/2]), random[:size/2]...)
+	fewBytes := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7}, size)[:size]
+	encode := base64.StdEncoding.EncodeToString
+
+	tests := []struct {
+		name    string
+		encoded string
+		wantErr bool
+	}{
+		{"random key", encode(random), false},
+		{"too short", encode(random[:size-1]), true},
+		{"too long", encode(append(bytes.Clone(random), 0)), true},
+		{"half of the size", encode(random[:size/2]), true},
+		{"empty", "", true},
+		{"not base64", "not base64!", true},
+		{"all zeros", encode(make([]byte, size)), true},
+		{"single repeated byte", encode(bytes.Repeat([]byte{0xaa}, size)), true},
+		{"few distinct bytes", encode(fewBytes), true},
+		{"repeated half", encode(repeatedHalf), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := DecodeQKDKey(tt.encoded, size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeQKDKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(key, random) {
+				t.Errorf("DecodeQKDKey() = %x, want %x", key, random)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package util
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/term"
+)
+
+const (
+	keyFileVersion = 1
+	keyFileKDF     = "argon2id"
+	keyFileCipher  = "xchacha20-poly1305"
+
+	// Environment variable with the passphrase, for running without a terminal.
+	PassphraseEnv = "PQGCH_PASSPHRASE"
+
+	passphraseAttempts = 3
+)
+
+// Argon2id parameters, as recommended by RFC 9106 for memory constrained environments.
+var defaultArgon2Params = Argon2Params{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+type Argon2Params struct {
+	Time    uint32 `json:"t"`
+	Memory  uint32 `json:"m"` // In KiB.
+	Threads uint8  `json:"p"`
+}
+
+// Header of the encrypted key file. The whole header is authenticated together with the key.
+type keyFileHeader struct {
+	Version int          `json:"version"`
+	KDF     string       `json:"kdf"`
+	Params  Argon2Params `json:"params"`
+	Cipher  string       `json:"cipher"`
+	Salt    string       `json:"salt"`
+	Nonce   string       `json:"nonce"`
+}
+
+// Secret key encrypted with a key derived from a passphrase.
+type encryptedKeyFile struct {
+	keyFileHeader
+	Ciphertext string `json:"ciphertext"`
+}
+
+var (
+	ErrWrongPassphrase = errors.New("wrong passphrase or corrupted key file")
+
+	passphraseMu   sync.Mutex
+	passphrase     []byte                           // Last passphrase that decrypted a key file.
+	unlockedKeys   = map[[sha256.Size]byte][]byte{} // Digest of the key file -> decrypted key, so we ask for the passphrase only once.
+	promptDisabled bool                             // Set once the terminal belongs to the user interface.
+)
+
+// Encrypt the key with the passphrase, returning the contents of the key file.
+func EncryptKey(key, passphrase []byte) ([]byte, error) {
+	header := keyFileHeader{
+		Version: keyFileVersion,
+		KDF:     keyFileKDF,
+		Params:  defaultArgon2Params,
+		Cipher:  keyFileCipher,
+	}
+	salt := make([]byte, 16)
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	rand.Read(salt)
+	rand.Read(nonce)
+	header.Salt = base64.StdEncoding.EncodeToString(salt)
+	header.Nonce = base64.StdEncoding.EncodeToString(nonce)
+
+	aead, err := header.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	ad, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	file := encryptedKeyFile{
+		keyFileHeader: header,
+		Ciphertext:    base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, key, ad)),
+	}
+	return json.MarshalIndent(file, "", "  ")
+}
+
+// Decrypt the contents of the key file with the passphrase.
+func DecryptKey(data, passphrase []byte) ([]byte, error) {
+	var file encryptedKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid encrypted key file: %w", err)
+	}
+	header := file.keyFileHeader
+	if header.Version != keyFileVersion {
+		return nil, fmt.Errorf("unsupported key file version %d", header.Version)
+	}
+	if header.KDF != keyFileKDF || header.Cipher != keyFileCipher {
+		return nil, fmt.Errorf("unsupported key file algorithms %s and %s", header.KDF, header.Cipher)
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(header.Nonce)
+	if err != nil || len(nonce) != chacha20poly1305.NonceSizeX {
+		return nil, errors.New("invalid nonce in key file")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(file.Ciphertext)
+	if err != nil {
+		return nil, errors.New("invalid ciphertext in key file")
+	}
+
+	aead, err := header.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	ad, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	key, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// Derive the encryption key from the passphrase using the parameters of the header.
+func (h keyFileHeader) aead(passphrase []byte) (cipher.AEAD, error) {
+	salt, err := base64.StdEncoding.DecodeString(h.Salt)
+	if err != nil || len(salt) < 16 {
+		return nil, errors.New("invalid salt in key file")
+	}
+	// Bound the parameters, so a crafted key file cannot make us allocate arbitrary memory.
+	p := h.Params
+	if p.Time == 0 || p.Time > 16 || p.Memory < 8*1024 || p.Memory > 1024*1024 || p.Threads == 0 {
+		return nil, fmt.Errorf("unsupported argon2id parameters %+v", p)
+	}
+
+	key := argon2.IDKey(passphrase, salt, p.Time, p.Memory, p.Threads, chacha20poly1305.KeySize)
+	defer clear(key)
+	return chacha20poly1305.NewX(key)
+}
+
+// Encryption settings of an encrypted key file.
+type KeyFileInfo struct {
+	Version int          `json:"version"`
+	KDF     string       `json:"kdf"`
+	Params  Argon2Params `json:"params"`
+	Cipher  string       `json:"cipher"`
+}
+
+// Get the encryption settings of the key file contents without decrypting them, false if they are not encrypted.
+func EncryptedKeyFileInfo(data []byte) (KeyFileInfo, bool) {
+	var file encryptedKeyFile
+	if !isEncryptedKeyFile(data) || json.Unmarshal(data, &file) != nil {
+		return KeyFileInfo{}, false
+	}
+	h := file.keyFileHeader
+	return KeyFileInfo{Version: h.Version, KDF: h.KDF, Params: h.Params, Cipher: h.Cipher}, true
+}
+
+// Load the key from a key file, decrypting it if it is encrypted.
+// The user is asked for the passphrase, unless it is known already or given in the environment.
+func LoadKeyFile(path string) ([]byte, error) {
+	return loadJSONKey(path)
+}
+
+// Report whether the key file contents are encrypted.
+func isEncryptedKeyFile(data []byte) bool {
+	var probe struct {
+		Ciphertext *string `json:"ciphertext"`
+	}
+	return json.Unmarshal(data, &probe) == nil && probe.Ciphertext != nil
+}
+
+// Decrypt the key file at path. The passphrase that decrypted the previous key file is tried first,
+// then the user is asked for it. Decrypted keys are remembered, so the user is asked only while loading
+// the configuration, before the terminal user interface starts. A key file replaced later, for example
+// before a config reload, has to be encrypted with the same passphrase.
+func unlockKeyFile(path string, data []byte) ([]byte, error) {
+	passphraseMu.Lock()
+	defer passphraseMu.Unlock()
+
+	digest := sha256.Sum256(data)
+	if key, found := unlockedKeys[digest]; found {
+		return key, nil
+	}
+
+	if passphrase != nil {
+		if key, err := DecryptKey(data, passphrase); err == nil {
+			unlockedKeys[digest] = key
+			return key, nil
+		}
+	}
+
+	if env, found := os.LookupEnv(PassphraseEnv); found {
+		key, err := DecryptKey(data, []byte(env))
+		if err != nil {
+			return nil, err
+		}
+		passphrase = []byte(env)
+		unlockedKeys[digest] = key
+		return key, nil
+	}
+
+	if promptDisabled {
+		return nil, fmt.Errorf("%s is encrypted with a different passphrase, restart to enter it", path)
+	}
+
+	for attempt := 1; ; attempt++ {
+		input, err := ReadPassphrase(fmt.Sprintf("Passphrase for %s: ", path))
+		if err != nil {
+			return nil, err
+		}
+		key, err := DecryptKey(data, input)
+		if err == nil {
+			passphrase = input
+			unlockedKeys[digest] = key
+			return key, nil
+		}
+		clear(input)
+		if !errors.Is(err, ErrWrongPassphrase) || attempt == passphraseAttempts {
+			return nil, err
+		}
+		fmt.Fprintln(os.Stderr, "Wrong passphrase, try again.")
+	}
+}
+
+// Get the passphrase that decrypted the last encrypted key file, nil if none was decrypted.
+func UnlockPassphrase() []byte {
+	passphraseMu.Lock()
+	defer passphraseMu.Unlock()
+	return slices.Clone(passphrase)
+}
+
+// Stop asking for passphrases on the terminal, once the terminal user interface uses it.
+func disablePassphrasePrompt() {
+	passphraseMu.Lock()
+	defer passphraseMu.Unlock()
+	promptDisabled = true
+}
+
+// Ask for a passphrase on the terminal without echoing it.
+// The controlling terminal is used, so it works even if the standard input carries the messages.
+func ReadPassphrase(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot ask for the passphrase without a terminal, set %s instead: %w", PassphraseEnv, err)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	input, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read passphrase: %w", err)
+	}
+	return input, nil
+}
@@ -0,0 +1,127 @@
+package util
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptKeyRoundTrip(t *testing.T) {
+	key := []byte("secret key material")
+	data, err := EncryptKey(key, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("EncryptKey(): %v", err)
+	}
+	if bytes.Contains(data, key) || bytes.Contains(data, []byte(base64.StdEncoding.EncodeToString(key))) {
+		t.Fatal("key file contains the plaintext key")
+	}
+
+	info, encrypted := EncryptedKeyFileInfo(data)
+	if !encrypted || info.KDF != keyFileKDF || info.Cipher != keyFileCipher || info.Params != defaultArgon2Params {
+		t.Errorf("EncryptedKeyFileInfo() = %+v, %v", info, encrypted)
+	}
+
+	got, err := DecryptKey(data, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("DecryptKey(): %v", err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Errorf("DecryptKey() = %q, want %q", got, key)
+	}
+
+	if _, err := DecryptKey(data, []byte("wrong horse")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("DecryptKey() with a wrong passphrase: %v, want ErrWrongPassphrase", err)
+	}
+}
+
+// Every field of the key file is authenticated or validated, so modified files are rejected.
+func TestDecryptKeyRejectsModifiedFiles(t *testing.T) {
+	data, err := EncryptKey([]byte("secret key material"), []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(file *encryptedKeyFile)
+	}{
+		{"ciphertext", func(file *encryptedKeyFile) {
+			ciphertext, _ := base64.StdEncoding.DecodeString(file.Ciphertext)
+			ciphertext[0] ^= 1
+			file.Ciphertext = base64.StdEncoding.EncodeToString(ciphertext)
+		}},
+		{"salt", func(file *encryptedKeyFile) {
+			file.Salt = base64.StdEncoding.EncodeToString(make([]byte, 16))
+		}},
+		{"nonce", func(file *encryptedKeyFile) {
+			nonce, _ := base64.StdEncoding.DecodeString(file.Nonce)
+			nonce[0] ^= 1
+			file.Nonce = base64.StdEncoding.EncodeToString(nonce)
+		}},
+		{"argon2 time", func(file *encryptedKeyFile) { file.Params.Time++ }},
+		{"argon2 memory over the bound", func(file *encryptedKeyFile) { file.Params.Memory = 4 * 1024 * 1024 }},
+		{"version", func(file *encryptedKeyFile) { file.Version = 2 }},
+		{"cipher", func(file *encryptedKeyFile) { file.Cipher = "aes-256-gcm" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var file encryptedKeyFile
+			if err := json.Unmarshal(data, &file); err != nil {
+				t.Fatal(err)
+			}
+			tt.modify(&file)
+			modified, err := json.Marshal(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := DecryptKey(modified, []byte("correct horse")); err == nil {
+				t.Error("DecryptKey() accepted a modified key file")
+			}
+		})
+	}
+}
+
+func TestLoadKeyFileWithPassphraseEnv(t *testing.T) {
+	t.Setenv(PassphraseEnv, "correct horse")
+	t.Cleanup(func() {
+		passphraseMu.Lock()
+		defer passphraseMu.Unlock()
+		passphrase = nil
+		clear(unlockedKeys)
+	})
+
+	key := []byte("secret key material")
+	data, err := EncryptKey(key, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	encrypted := filepath.Join(dir, "encrypted.json")
+	plain := filepath.Join(dir, "plain.json")
+	os.WriteFile(encrypted, data, 0o600)
+	os.WriteFile(plain, []byte(`{"key": "`+base64.StdEncoding.EncodeToString(key)+`"}`), 0o600)
+
+	for _, path := range []string{encrypted, plain} {
+		got, err := LoadKeyFile(path)
+		if err != nil {
+			t.Fatalf("LoadKeyFile(%s): %v", filepath.Base(path), err)
+		}
+		if !bytes.Equal(got, key) {
+			t.Errorf("LoadKeyFile(%s) = %q, want %q", filepath.Base(path), got, key)
+		}
+	}
+
+	t.Setenv(PassphraseEnv, "wrong horse")
+	passphraseMu.Lock()
+	passphrase = nil
+	clear(unlockedKeys)
+	passphraseMu.Unlock()
+	if _, err := LoadKeyFile(encrypted); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("LoadKeyFile() with a wrong passphrase: %v, want ErrWrongPassphrase", err)
+	}
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// Connect to a local routing server listening on a Unix domain socket.
+func NewUnixTransport(path string, receiveChan chan Message, clientID, clusterID int) (*StreamTransport, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStreamTransport(conn, conn, receiveChan, clientID, clusterID), nil
+}
+
+// Exchange messages over the standard input and output, using the same framing as over TCP.
+// This lets a supervisor or a test driver play the role of the routing server.
+// The terminal user interface cannot be used in this mode, see StartHeadless.
+func NewStdioTransport(receiveChan chan Message, clientID, clusterID int) *StreamTransport {
+	return newStreamTransport(os.Stdin, os.Stdout, receiveChan, clientID, clusterID)
+}
+
+// Address of the Unix socket, or an empty string if the server address does not use the unix: scheme.
+func unixSocketPath(address string) string {
+	if !strings.HasPrefix(strings.ToLower(address), "unix:") {
+		return ""
+	}
+	return strings.TrimPrefix(address[len("unix:"):], "//")
+}
+
+// Check whether the server address selects the transport over the standard input and output.
+func IsStdioAddress(address string) bool {
+	low := strings.ToLower(strings.TrimSpace(address))
+	return low == "stdio:" || low == "stdio://" || low == "stdio"
+}
@@ -0,0 +1,19 @@
+package util
+
+import (
+	"os"
+	"testing"
+)
+
+// Logging blocks once nobody reads the log channels, so the tests discard everything logged.
+func TestMain(m *testing.M) {
+	go func() {
+		for {
+			select {
+			case <-logChan:
+			case <-msgChan:
+			}
+		}
+	}()
+	os.Exit(m.Run())
+}
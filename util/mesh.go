@@ -0,0 +1,420 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMulticastGroup = "239.255.80.71:9797"
+	announcePrefix        = "pqgch-mesh"
+	announceInterval      = 5 * time.Second
+	redialInterval        = 2 * time.Second
+	meshHistorySize       = 256              // Number of sent protocol messages kept for participants connecting later.
+	meshDrainTimeout      = 10 * time.Second // How long a replaced connection is still read, see drain.
+)
+
+// Identity of a mesh participant. It is learned from the authentication message
+// every participant sends as the first message on a connection.
+type meshID struct {
+	clusterID int
+	memberID  int
+	leader    bool
+}
+
+func helloID(hello Message) meshID {
+	return meshID{
+		clusterID: hello.ClusterID,
+		memberID:  hello.SenderID,
+		leader:    hello.Type == LeaderAuthMsg,
+	}
+}
+
+// Order of the identities, used to agree on the connection two participants keep.
+func (id meshID) less(other meshID) bool {
+	if id.clusterID != other.clusterID {
+		return id.clusterID < other.clusterID
+	}
+	if id.leader != other.leader {
+		return other.leader
+	}
+	return id.memberID < other.memberID
+}
+
+type meshPeer struct {
+	id       meshID
+	name     string
+	conn     net.Conn
+	dialed   bool // We dialed the connection, the peer accepted it.
+	replaced bool // The connection was closed in favor of another one to the same peer.
+	mu       sync.Mutex
+}
+
+func (p *meshPeer) send(msg Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return msg.Send(p.conn)
+}
+
+// Message sent by us, together with the set of participants it was already delivered to.
+// Participants that connect later still receive the messages addressed to them.
+type meshEntry struct {
+	msg       Message
+	delivered map[meshID]bool
+}
+
+// MeshTransport connects the participants directly to each other without a routing server.
+// It delivers every message to the participants included in its To address.
+type MeshTransport struct {
+	config      MeshConfig
+	receiveChan chan Message
+	nonce       string
+
+	mu      sync.Mutex
+	hello   *Message             // Our authentication message, nil until the session logs in.
+	conns   map[net.Conn]bool    // All open connections, identified or not.
+	peers   map[meshID]*meshPeer // Identified participants.
+	dialing map[string]bool      // Addresses we are currently connected or connecting to.
+	history []*meshEntry         // Most recent protocol messages sent by us, at most meshHistorySize.
+}
+
+func NewMeshTransport(config MeshConfig, receiveChan chan Message) (*MeshTransport, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("cannot generate the mesh nonce: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %q: %w", config.Listen, err)
+	}
+
+	t := &MeshTransport{
+		config:      config,
+		receiveChan: receiveChan,
+		nonce:       hex.EncodeToString(nonce),
+		conns:       make(map[net.Conn]bool),
+		peers:       make(map[meshID]*meshPeer),
+		dialing:     make(map[string]bool),
+	}
+
+	go t.accept(listener)
+	for _, peer := range config.Peers {
+		go t.dial(peer, true)
+	}
+	if config.HasMulticast() {
+		if err := t.startDiscovery(listener.Addr().(*net.TCPAddr).Port); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	LogInfo(fmt.Sprintf("Mesh listening on %s", listener.Addr()))
+	return t, nil
+}
+
+// Send the message to every connected participant it is addressed to.
+// The authentication message is not routed, it is used as our hello towards the other participants.
+func (t *MeshTransport) Send(msg Message) {
+	switch msg.Type {
+	case Ping:
+		return
+	case MemberAuthMsg, LeaderAuthMsg:
+		t.mu.Lock()
+		t.hello = &msg
+		conns := make([]net.Conn, 0, len(t.conns))
+		for conn := range t.conns {
+			conns = append(conns, conn)
+		}
+		t.mu.Unlock()
+
+		for _, conn := range conns {
+			t.sendHello(conn)
+		}
+		return
+	}
+
+	if err := msg.prepareRouting(); err != nil {
+		LogError(fmt.Sprintf("Refusing to send message: %v", err))
+		return
+	}
+
+	entry := &meshEntry{msg: msg, delivered: make(map[meshID]bool)}
+
+	t.mu.Lock()
+	if msg.Type != TextMsg {
+		t.remember(entry)
+	}
+	var targets []*meshPeer
+	for id, peer := range t.peers {
+		if meshRoutes(msg, id) {
+			entry.delivered[id] = true
+			targets = append(targets, peer)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, peer := range targets {
+		t.deliver(peer, entry)
+	}
+}
+
+// Send the message of the entry to the peer, which it is already marked as delivered to.
+// When the send fails, the mark is cleared, so the message is sent again when the peer registers anew.
+// If the peer was already replaced by another connection, which skipped the message, it is sent over that one.
+func (t *MeshTransport) deliver(peer *meshPeer, entry *meshEntry) {
+	err := peer.send(entry.msg)
+	if err == nil {
+		return
+	}
+	LogError(fmt.Sprintf("Failed to send message to %s: %v", peer.name, err))
+
+	t.mu.Lock()
+	current := t.peers[peer.id]
+	replaced := current != nil && current != peer
+	if !replaced {
+		delete(entry.delivered, peer.id)
+	}
+	t.mu.Unlock()
+
+	if replaced {
+		t.deliver(current, entry)
+	}
+}
+
+// Keep the message for the participants connecting later, forgetting the oldest one when the history is full.
+// Must be called with t.mu held.
+func (t *MeshTransport) remember(entry *meshEntry) {
+	if len(t.history) >= meshHistorySize {
+		t.history[0] = nil
+		t.history = t.history[1:]
+	}
+	t.history = append(t.history, entry)
+}
+
+// Decide whether the message is addressed to the participant with the given identity.
+func meshRoutes(msg Message, id meshID) bool {
+	return msg.To.Includes(id.clusterID, id.memberID, id.leader)
+}
+
+func (t *MeshTransport) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			LogError(fmt.Sprintf("Mesh listener stopped: %v", err))
+			return
+		}
+		go t.serve(conn, false)
+	}
+}
+
+// Connect to the peer at the given address. Static peers are redialed until the transport exits,
+// discovered peers are forgotten once the connection is closed and dialed again on the next announcement.
+// When the peer is already connected to us by its own connection, ours is dropped and we only dial again
+// once that connection is gone.
+func (t *MeshTransport) dial(address string, static bool) {
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			if id, duplicate := t.serve(conn, true); duplicate {
+				for t.connected(id) {
+					time.Sleep(redialInterval)
+				}
+			}
+		}
+		if !static {
+			t.mu.Lock()
+			delete(t.dialing, address)
+			t.mu.Unlock()
+			return
+		}
+		time.Sleep(redialInterval)
+	}
+}
+
+func (t *MeshTransport) connected(id meshID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.peers[id] != nil
+}
+
+// Read messages from the connection until it is closed.
+// The first message has to be the hello of the peer, everything before it is ignored.
+// Returns the identity of the peer and whether the connection was closed because the peer
+// is connected to us by another one.
+func (t *MeshTransport) serve(conn net.Conn, dialed bool) (meshID, bool) {
+	t.mu.Lock()
+	t.conns[conn] = true
+	t.mu.Unlock()
+
+	t.sendHello(conn)
+
+	var peer *meshPeer
+	reader := NewMessageReader(conn)
+	for reader.HasMessage() {
+		msg := reader.GetMessage()
+		switch msg.Type {
+		case MemberAuthMsg, LeaderAuthMsg:
+			if peer != nil {
+				continue
+			}
+			if peer = t.register(conn, msg, dialed); peer == nil {
+				// The peer keeps its other connection, but it may have sent messages over this one
+				// before it learned about it, so they are still read.
+				peer = &meshPeer{id: helloID(msg), name: msg.SenderName, replaced: true}
+				drain(conn)
+			}
+		case Ping, Pong:
+		default:
+			if peer == nil {
+				LogError("Dropping message from unidentified mesh peer")
+				continue
+			}
+			dispatch(msg, t.receiveChan)
+		}
+	}
+
+	conn.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, conn)
+	if peer == nil {
+		return meshID{}, false
+	}
+	if t.peers[peer.id] == peer {
+		delete(t.peers, peer.id)
+	}
+	return peer.id, peer.replaced
+}
+
+func (t *MeshTransport) sendHello(conn net.Conn) {
+	t.mu.Lock()
+	hello := t.hello
+	t.mu.Unlock()
+
+	if hello == nil {
+		return
+	}
+	if err := hello.Send(conn); err != nil {
+		LogError(fmt.Sprintf("Failed to greet mesh peer: %v", err))
+	}
+}
+
+// Register the peer that greeted us and deliver the messages it has missed.
+// As both sides of a pair dial each other, the peer may already be connected by another connection.
+// Only the connection dialed by the lower of the two identities is kept, so both sides keep the same one;
+// nil is returned when the new connection is the one to drop.
+func (t *MeshTransport) register(conn net.Conn, hello Message, dialed bool) *meshPeer {
+	peer := &meshPeer{
+		id:     helloID(hello),
+		name:   hello.SenderName,
+		conn:   conn,
+		dialed: dialed,
+	}
+
+	t.mu.Lock()
+	existing := t.peers[peer.id]
+	if existing != nil {
+		// A connection in the same direction replaces the old one, which is most likely dead.
+		if existing.dialed != dialed && t.hello != nil && dialed != helloID(*t.hello).less(peer.id) {
+			t.mu.Unlock()
+			return nil
+		}
+		existing.replaced = true
+		drain(existing.conn)
+	}
+	t.peers[peer.id] = peer
+	var missed []*meshEntry
+	for _, entry := range t.history {
+		if !entry.delivered[peer.id] && meshRoutes(entry.msg, peer.id) {
+			entry.delivered[peer.id] = true
+			missed = append(missed, entry)
+		}
+	}
+	t.mu.Unlock()
+
+	if existing == nil {
+		LogRoute(fmt.Sprintf("Mesh peer %s connected from %s", peer.name, conn.RemoteAddr()))
+	}
+
+	for _, entry := range missed {
+		t.deliver(peer, entry)
+	}
+
+	return peer
+}
+
+// Stop sending over a connection replaced by another one to the same peer, and close it once the peer closes its side.
+// Messages the peer has already sent over it are still read, so none of them is lost. A peer which does not close
+// its side in time, for example because the connection is dead, is cut off.
+func drain(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(meshDrainTimeout))
+}
+
+// Periodically announce our listening port to the multicast group and dial every participant announcing itself.
+func (t *MeshTransport) startDiscovery(port int) error {
+	group, err := net.ResolveUDPAddr("udp4", t.config.MulticastGroupAddr())
+	if err != nil {
+		return fmt.Errorf("invalid multicast group %q: %w", t.config.MulticastGroupAddr(), err)
+	}
+
+	listenConn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return fmt.Errorf("cannot join multicast group %s: %w", group, err)
+	}
+
+	sendConn, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		listenConn.Close()
+		return fmt.Errorf("cannot send to multicast group %s: %w", group, err)
+	}
+
+	announcement := []byte(fmt.Sprintf("%s %s %d", announcePrefix, t.nonce, port))
+	go func() {
+		ticker := time.NewTicker(announceInterval)
+		defer ticker.Stop()
+		for {
+			sendConn.Write(announcement)
+			<-ticker.C
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, src, err := listenConn.ReadFromUDP(buf)
+			if err != nil {
+				LogError(fmt.Sprintf("Mesh discovery stopped: %v", err))
+				return
+			}
+			fields := strings.Fields(string(buf[:n]))
+			if len(fields) != 3 || fields[0] != announcePrefix || fields[1] == t.nonce {
+				continue
+			}
+			if _, err := strconv.Atoi(fields[2]); err != nil {
+				continue
+			}
+
+			address := net.JoinHostPort(src.IP.String(), fields[2])
+			t.mu.Lock()
+			known := t.dialing[address]
+			t.dialing[address] = true
+			t.mu.Unlock()
+
+			if !known {
+				go t.dial(address, false)
+			}
+		}
+	}()
+
+	return nil
+}
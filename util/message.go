@@ -3,19 +3,157 @@ package util
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"reflect"
+	"time"
 )
 
 type Message struct {
 	// Routing metadata
-	SenderID   int `json:"sendId"`
+	SenderID  int     `json:"sendId"`
+	ClusterID int     `json:"clusterId"` // Cluster of the sender.
+	To        Address `json:"to"`
+	Type      int     `json:"type"`
+	// Legacy routing field for routing servers which do not understand the To address.
+	// It is derived from To by the transports, the protocols never set it.
 	ReceiverID int `json:"recvId"`
-	Type       int `json:"type"`
-	ClusterID  int `json:"clusterId"`
 	// Message content for user
 	SenderName string `json:"sender"`
 	Content    string `json:"content"`
+	// Epoch of the Main Session Key a text message is encrypted with, see EpochID.
+	// Lets the mailbox keep the ciphertext with its epoch, empty for every other message.
+	Epoch string `json:"epoch,omitempty"`
+	// Round of the run of the key exchange a protocol message belongs to, see NewRound.
+	// Lets the participants tell a new run from a late or replayed message of an old one, zero for every other message.
+	Round int64 `json:"round,omitempty"`
+	// Key material of the messages delivering a QKD key to our own message handler, which erases it once it is used.
+	// It is never sent.
+	Key []byte `json:"-"`
+}
+
+// Kind of the message destination.
+type DestKind int
+
+const (
+	DestLocal   DestKind = iota // Not routed at all, used for messages passed between our own sessions.
+	DestServer                  // Consumed by the routing server (login, keepalive).
+	DestAll                     // Every participant.
+	DestCluster                 // Every participant in the cluster, including its leader.
+	DestMember                  // A single participant in the cluster.
+	DestLeaders                 // Every cluster leader.
+	DestLeader                  // The leader of the cluster.
+)
+
+var destKindNames = map[DestKind]string{
+	DestLocal:   "local",
+	DestServer:  "server",
+	DestAll:     "all",
+	DestCluster: "cluster",
+	DestMember:  "member",
+	DestLeaders: "leaders",
+	DestLeader:  "leader",
+}
+
+func (k DestKind) String() string {
+	if name, ok := destKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("DestKind(%d)", int(k))
+}
+
+// Address is the destination of a message. Cluster is only meaningful for DestCluster, DestMember and DestLeader,
+// Member only for DestMember. Use the To* constructors instead of filling it in directly.
+type Address struct {
+	Kind    DestKind `json:"kind"`
+	Cluster int      `json:"cluster"`
+	Member  int      `json:"member"`
+}
+
+func ToServer() Address {
+	return Address{Kind: DestServer}
+}
+
+func ToAll() Address {
+	return Address{Kind: DestAll}
+}
+
+func ToCluster(clusterID int) Address {
+	return Address{Kind: DestCluster, Cluster: clusterID}
+}
+
+func ToMember(clusterID, memberID int) Address {
+	return Address{Kind: DestMember, Cluster: clusterID, Member: memberID}
+}
+
+func ToLeaders() Address {
+	return Address{Kind: DestLeaders}
+}
+
+func ToLeader(clusterID int) Address {
+	return Address{Kind: DestLeader, Cluster: clusterID}
+}
+
+// Check whether the participant identified by the cluster, member and leader role is a recipient of the address.
+func (a Address) Includes(clusterID, memberID int, leader bool) bool {
+	switch a.Kind {
+	case DestAll:
+		return true
+	case DestCluster:
+		return a.Cluster == clusterID
+	case DestMember:
+		return a.Cluster == clusterID && a.Member == memberID
+	case DestLeaders:
+		return leader
+	case DestLeader:
+		return leader && a.Cluster == clusterID
+	default:
+		return false
+	}
+}
+
+// Destination kind every message type has to be sent to.
+var messageDestKinds = map[int]DestKind{
+	MemberAuthMsg:           DestServer,
+	LeaderAuthMsg:           DestServer,
+	Ping:                    DestServer,
+	TextMsg:                 DestAll,
+	AkeOneMsg:               DestMember,
+	AkeTwoMsg:               DestMember,
+	XiRiCommitmentMsg:       DestCluster,
+	KeyMsg:                  DestCluster,
+	QKDIDMemberMsg:          DestCluster,
+	MailboxFetchMsg:         DestLeader,
+	MailboxMsg:              DestMember,
+	LeadAkeOneMsg:           DestLeader,
+	LeadAkeTwoMsg:           DestLeader,
+	QKDIDLeaderMsg:          DestLeader,
+	LeaderXiRiCommitmentMsg: DestLeaders,
+}
+
+// Check that the message is addressed the way its type requires and fill in the legacy routing field.
+// Transports call this before sending, so a misaddressed message never leaves the client.
+func (m *Message) prepareRouting() error {
+	expected, ok := messageDestKinds[m.Type]
+	if !ok {
+		return fmt.Errorf("%s is not meant to be sent", m.TypeName())
+	}
+	if m.To.Kind != expected {
+		return fmt.Errorf("%s must be addressed to %s, not %s", m.TypeName(), expected, m.To.Kind)
+	}
+
+	switch m.To.Kind {
+	case DestMember:
+		m.ReceiverID = m.To.Member
+	case DestLeader:
+		m.ReceiverID = m.To.Cluster
+	default:
+		m.ReceiverID = 0
+	}
+	return nil
 }
 
 var MessageTypeNames = map[int]string{
@@ -34,6 +172,12 @@ var MessageTypeNames = map[int]string{
 	QKDClusterKeyMsg:        "Cluster QKD Key Message",
 	QKDIDLeaderMsg:          "QKD ID Message",
 	QKDIDMemberMsg:          "QKD ID Message",
+	Ping:                    "Ping Message",
+	Pong:                    "Pong Message",
+	Error:                   "Error Message",
+	MainSessionKeyMsg:       "Main Session Key Message",
+	MailboxFetchMsg:         "Mailbox Fetch Message",
+	MailboxMsg:              "Mailbox Backlog Message",
 }
 
 func (m Message) TypeName() string {
@@ -62,19 +206,37 @@ const (
 	QKDRightKeyMsg    // Response from the ETSI API server for Right Key.
 	QKDClusterKeyMsg  // Response from the ETSI API server for Cluster Session Key.
 	MainSessionKeyMsg // Internal message used for transport from leader_protocol to cluster_protocol.
+	MailboxFetchMsg   // Request for the text messages stored in the mailbox of the cluster leader.
+	MailboxMsg        // Stored text messages sent by the cluster leader to the member who requested them.
 )
 
 func (m *Message) IsClusterType() bool {
 	switch m.Type {
 	case AkeOneMsg, AkeTwoMsg, XiRiCommitmentMsg, KeyMsg,
-		MainSessionKeyMsg, QKDClusterKeyMsg, TextMsg:
+		MainSessionKeyMsg, QKDClusterKeyMsg, TextMsg,
+		MailboxFetchMsg, MailboxMsg:
 		return true
 	default:
 		return false
 	}
 }
 
-func (m Message) Send(conn net.Conn) error {
+// How far ahead of our clock the round of a received message may be. Rounds further ahead are rejected,
+// so a forged message cannot pin the round and stop all later runs of the key exchange.
+const MaxRoundSkew = time.Minute
+
+// Get the round of a new run of a key exchange, later than the current round.
+// Rounds are timestamps, so a participant starting again with a fresh session still starts a newer run.
+func NewRound(current int64) int64 {
+	return max(time.Now().UnixNano(), current+1)
+}
+
+// Report whether the round of a received message is not further ahead of our clock than MaxRoundSkew.
+func PlausibleRound(round int64) bool {
+	return round <= time.Now().Add(MaxRoundSkew).UnixNano()
+}
+
+func (m Message) Send(conn io.Writer) error {
 	msgData, err := json.Marshal(m)
 	if err != nil {
 		return fmt.Errorf("error marshaling message: %w", err)
@@ -96,7 +258,7 @@ type MessageReader struct {
 	hasNext bool
 }
 
-func NewMessageReader(conn net.Conn) *MessageReader {
+func NewMessageReader(conn io.Reader) *MessageReader {
 	reader := &MessageReader{
 		scanner: bufio.NewScanner(conn),
 	}
@@ -116,7 +278,7 @@ func (reader *MessageReader) advance() {
 			reader.hasNext = true
 		}
 	} else {
-		if err := reader.scanner.Err(); err != nil {
+		if err := reader.scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
 			LogError(fmt.Sprintf("Error reading from connection: %v", err))
 		} else {
 			LogInfo("Connection closed")
@@ -138,5 +300,5 @@ func (reader *MessageReader) GetMessage() Message {
 }
 
 func (m Message) IsEmpty() bool {
-	return m == Message{}
+	return reflect.ValueOf(m).IsZero()
 }
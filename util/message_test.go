@@ -0,0 +1,84 @@
+package util
+
+import "testing"
+
+func TestAddressIncludes(t *testing.T) {
+	tests := []struct {
+		name      string
+		address   Address
+		clusterID int
+		memberID  int
+		leader    bool
+		want      bool
+	}{
+		{"all includes members", ToAll(), 3, 1, false, true},
+		{"all includes leaders", ToAll(), 0, 0, true, true},
+		{"cluster includes its member", ToCluster(1), 1, 2, false, true},
+		{"cluster includes its leader", ToCluster(1), 1, 3, true, true},
+		{"cluster excludes other clusters", ToCluster(1), 2, 2, false, false},
+		{"member includes itself", ToMember(1, 2), 1, 2, false, true},
+		{"member excludes other members", ToMember(1, 2), 1, 3, false, false},
+		{"member excludes same ID in another cluster", ToMember(1, 2), 0, 2, false, false},
+		{"leaders include every leader", ToLeaders(), 5, 0, true, true},
+		{"leaders exclude members", ToLeaders(), 5, 0, false, false},
+		{"leader includes its cluster's leader", ToLeader(2), 2, 4, true, true},
+		{"leader excludes other leaders", ToLeader(2), 1, 4, true, false},
+		{"leader excludes members of its cluster", ToLeader(2), 2, 0, false, false},
+		{"server includes nobody", ToServer(), 0, 0, true, false},
+		{"local includes nobody", Address{Kind: DestLocal}, 0, 0, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.address.Includes(tt.clusterID, tt.memberID, tt.leader); got != tt.want {
+				t.Errorf("%+v.Includes(%d, %d, %v) = %v, want %v", tt.address, tt.clusterID, tt.memberID, tt.leader, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareRouting(t *testing.T) {
+	tests := []struct {
+		name       string
+		msg        Message
+		wantErr    bool
+		receiverID int
+	}{
+		{"member message routed by member ID", Message{Type: AkeOneMsg, To: ToMember(1, 2)}, false, 2},
+		{"leader message routed by cluster ID", Message{Type: LeadAkeOneMsg, To: ToLeader(3)}, false, 3},
+		{"mailbox fetch routed to the leader", Message{Type: MailboxFetchMsg, To: ToLeader(4)}, false, 4},
+		{"cluster message has no receiver", Message{Type: XiRiCommitmentMsg, To: ToCluster(1), ReceiverID: 7}, false, 0},
+		{"text message has no receiver", Message{Type: TextMsg, To: ToAll()}, false, 0},
+		{"login goes to the server", Message{Type: MemberAuthMsg, To: ToServer()}, false, 0},
+		{"wrong destination kind", Message{Type: AkeOneMsg, To: ToCluster(1)}, true, 0},
+		{"missing address", Message{Type: TextMsg}, true, 0},
+		{"local message is not sent", Message{Type: MainSessionKeyMsg, To: Address{Kind: DestLocal}}, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.msg
+			err := msg.prepareRouting()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("prepareRouting() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && msg.ReceiverID != tt.receiverID {
+				t.Errorf("ReceiverID = %d, want %d", msg.ReceiverID, tt.receiverID)
+			}
+		})
+	}
+}
+
+func TestRounds(t *testing.T) {
+	now := NewRound(0)
+	if next := NewRound(now); next <= now {
+		t.Errorf("NewRound(%d) = %d, want a later round", now, next)
+	}
+	future := now + 2*int64(MaxRoundSkew)
+	if next := NewRound(future); next != future+1 {
+		t.Errorf("NewRound(%d) = %d, want %d", future, next, future+1)
+	}
+	if !PlausibleRound(now) || PlausibleRound(future) {
+		t.Errorf("PlausibleRound() accepts %d: %v, %d: %v", now, PlausibleRound(now), future, PlausibleRound(future))
+	}
+}
@@ -0,0 +1,221 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Prefix of the environment variables overriding config fields.
+const configEnvPrefix = "PQGCH_"
+
+// Field of the configuration which can be overridden, found by walking BaseConfig.
+type configField struct {
+	path  string // JSON path of the field, for example cluster.memberID. Also the name of its flag.
+	index []int  // Indices of the struct fields leading to it from BaseConfig.
+}
+
+// Values given by the flags registered with RegisterConfigFlags, by JSON path.
+var flagOverrides = map[string]string{}
+
+// All fields of BaseConfig and its sections, in the order they are declared.
+var configFields = walkConfigFields(reflect.TypeOf(BaseConfig{}), "", nil)
+
+func walkConfigFields(t reflect.Type, prefix string, index []int) []configField {
+	var fields []configField
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		path := prefix + name
+		fieldIndex := append(append([]int{}, index...), i)
+
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer && ft.Elem().Kind() == reflect.Struct {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			fields = append(fields, walkConfigFields(ft, path+".", fieldIndex)...)
+		} else {
+			fields = append(fields, configField{path: path, index: fieldIndex})
+		}
+	}
+	return fields
+}
+
+// Name of the environment variable overriding the field: the JSON path in upper case,
+// with dots replaced by underscores, for example PQGCH_CLUSTER_MEMBERID.
+func (f configField) env() string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(f.path, ".", "_"))
+}
+
+// Register a flag for every config field, named after its JSON path, for example -cluster.memberID.
+// The values are applied by GetConfig, also when the configuration is reloaded.
+func RegisterConfigFlags(fs *flag.FlagSet) {
+	for _, f := range configFields {
+		fs.Func(f.path, fmt.Sprintf("override %s of the config file (env %s)", f.path, f.env()), func(value string) error {
+			flagOverrides[f.path] = value
+			return nil
+		})
+	}
+}
+
+// Report whether any config field is given by a flag or an environment variable.
+func HasConfigOverrides() bool {
+	if len(flagOverrides) > 0 {
+		return true
+	}
+	for _, f := range configFields {
+		if _, found := os.LookupEnv(f.env()); found {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply the environment variables and then the flags on top of the config file, so flags take precedence.
+// Sections are created when one of their fields is set. The overridden string fields are returned,
+// so their paths can be resolved relative to the working directory instead of the config file.
+func (c *BaseConfig) applyOverrides() (map[*string]bool, error) {
+	overridden := map[*string]bool{}
+	set := func(f configField, name, value string) error {
+		p, err := c.setField(f, value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q of %s: %w", value, name, err)
+		}
+		if p != nil {
+			overridden[p] = true
+		}
+		return nil
+	}
+	for _, f := range configFields {
+		if value, found := os.LookupEnv(f.env()); found {
+			if err := set(f, f.env(), value); err != nil {
+				return nil, err
+			}
+		}
+		if value, found := flagOverrides[f.path]; found {
+			if err := set(f, "-"+f.path, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return overridden, nil
+}
+
+// Set the field from its textual value. Lists are separated by commas.
+// A pointer to the field is returned if it is a plain string.
+func (c *BaseConfig) setField(f configField, value string) (*string, error) {
+	v := reflect.ValueOf(c).Elem()
+	for _, i := range f.index {
+		if v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+
+	value = strings.TrimSpace(value)
+	switch {
+	case v.Type() == reflect.TypeOf(CryptoKind("")):
+		v.SetString(strings.ToLower(value))
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+		return v.Addr().Interface().(*string), nil
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.New("not an integer")
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Pointer && v.Type().Elem().Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.New("not an integer")
+		}
+		v.Set(reflect.ValueOf(&n))
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("not a boolean")
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return nil, fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil, nil
+}
+
+// Write the configuration as JSON, with the credentials in the KME URLs redacted.
+// The key files themselves are only referenced by their paths, so they are never printed.
+func PrintConfig(w io.Writer, config BaseConfig) error {
+	// Work on a deep copy, the sections are shared with the running configuration.
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	var redacted BaseConfig
+	if err := json.Unmarshal(data, &redacted); err != nil {
+		return err
+	}
+	for _, source := range []*CryptoSource{redacted.clusterCrypto(), redacted.leaderCrypto(QKDLinkLeft), redacted.leaderCrypto(QKDLinkRight)} {
+		if source != nil && source.URL != "" {
+			source.URL = redactURL(source.URL)
+		}
+	}
+
+	data, err = json.MarshalIndent(redacted, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+func (c *BaseConfig) clusterCrypto() *CryptoSource {
+	if c.Cluster == nil {
+		return nil
+	}
+	return c.Cluster.Crypto
+}
+
+func (c *BaseConfig) leaderCrypto(link QKDLink) *CryptoSource {
+	if c.Leader == nil {
+		return nil
+	}
+	if link == QKDLinkRight {
+		return c.Leader.RightCrypto
+	}
+	return c.Leader.LeftCrypto
+}
+
+// Replace the password in the URL. Query parameters could carry tokens too, so they are replaced as well.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "xxxxx"
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "xxxxx"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,120 @@
+package util
+
+import (
+	"flag"
+	"slices"
+	"testing"
+)
+
+// Parse the flags as the binaries do, forgetting them once the test is done.
+func setFlagOverrides(t *testing.T, args ...string) {
+	t.Helper()
+	t.Cleanup(func() { clear(flagOverrides) })
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyOverridesPrecedence(t *testing.T) {
+	t.Setenv("PQGCH_SERVER", "env:9000")
+	t.Setenv("PQGCH_NAME", "env-name")
+	setFlagOverrides(t, "-name", "flag-name")
+
+	config := BaseConfig{Server: "file:9000", Name: "file-name", ClusterID: new(int)}
+	overridden, err := config.applyOverrides()
+	if err != nil {
+		t.Fatalf("applyOverrides(): %v", err)
+	}
+	if config.Server != "env:9000" {
+		t.Errorf("server = %q, want the environment to override the file", config.Server)
+	}
+	if config.Name != "flag-name" {
+		t.Errorf("name = %q, want the flag to override the environment", config.Name)
+	}
+	if *config.ClusterID != 0 {
+		t.Errorf("clusterID = %d, want the value of the file", *config.ClusterID)
+	}
+	if !overridden[&config.Server] || !overridden[&config.Name] {
+		t.Error("overridden strings are not reported")
+	}
+}
+
+func TestApplyOverridesFieldTypes(t *testing.T) {
+	t.Setenv("PQGCH_CLUSTER_MEMBERID", " 3 ")
+	t.Setenv("PQGCH_MESH_PEERS", "a:1, b:2,,c:3")
+	t.Setenv("PQGCH_QKD_MOCKSAEIDHEADER", "true")
+	setFlagOverrides(t, "-cluster.crypto.kind", "PSK", "-clusterID", "2")
+
+	var config BaseConfig
+	if _, err := config.applyOverrides(); err != nil {
+		t.Fatalf("applyOverrides(): %v", err)
+	}
+	if config.Cluster == nil || config.Cluster.MemberID == nil || *config.Cluster.MemberID != 3 {
+		t.Errorf("cluster = %+v, want the section created with memberID 3", config.Cluster)
+	}
+	if config.Cluster.Crypto == nil || config.Cluster.Crypto.Kind != CryptoPSK {
+		t.Errorf("cluster.crypto = %+v, want the kind in lower case", config.Cluster.Crypto)
+	}
+	if config.ClusterID == nil || *config.ClusterID != 2 {
+		t.Errorf("clusterID = %v, want 2", config.ClusterID)
+	}
+	if config.Mesh == nil || !slices.Equal(config.Mesh.Peers, []string{"a:1", "b:2", "c:3"}) {
+		t.Errorf("mesh = %+v, want the peers split on commas", config.Mesh)
+	}
+	if config.QKD == nil || !config.QKD.MockSAEIDHeader {
+		t.Errorf("qkd = %+v, want mockSaeIdHeader set", config.QKD)
+	}
+	if config.Leader != nil {
+		t.Errorf("leader = %+v, want no section without overrides", config.Leader)
+	}
+}
+
+func TestApplyOverridesInvalidValues(t *testing.T) {
+	tests := []struct {
+		env   string
+		value string
+	}{
+		{"PQGCH_CLUSTERID", "two"},
+		{"PQGCH_CLUSTER_NMEMBERS", "1.5"},
+		{"PQGCH_QKD_MOCKSAEIDHEADER", "maybe"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			var config BaseConfig
+			if _, err := config.applyOverrides(); err == nil {
+				t.Errorf("applyOverrides() accepted %s=%s", tt.env, tt.value)
+			}
+		})
+	}
+}
+
+func TestHasConfigOverrides(t *testing.T) {
+	if HasConfigOverrides() {
+		t.Skip("PQGCH_ variables are set in the environment")
+	}
+	setFlagOverrides(t, "-server", "router:9000")
+	if !HasConfigOverrides() {
+		t.Error("HasConfigOverrides() = false with a flag")
+	}
+}
+
+// Checking the files of a deployment must not depend on the environment of the one checking them.
+func TestLoadConfigFileIgnoresOverrides(t *testing.T) {
+	t.Setenv("PQGCH_NAME", "env-name")
+	path := writeTestFile(t, "config.json", BaseConfig{Server: "localhost:9000", Name: "alice", ClusterID: new(int)})
+
+	config, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("LoadConfigFile(): %v", err)
+	}
+	if config.Name != "alice" {
+		t.Errorf("name = %q, want the name in the file", config.Name)
+	}
+	if config, _ := GetConfig(path); config.Name != "env-name" {
+		t.Errorf("GetConfig() name = %q, want the override", config.Name)
+	}
+}
@@ -0,0 +1,256 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+var (
+	// Returned by Take when the pool is closed while waiting for a key.
+	ErrPoolClosed = errors.New("key pool closed")
+	// The KME reports no keys ready for us. It counts as a failed attempt of the retry policy,
+	// so a KME which stays exhausted is reported instead of being polled forever.
+	ErrKMEExhausted = errors.New("KME has no keys ready")
+)
+
+type pooledKey struct {
+	id  string
+	key []byte
+}
+
+// KeyPool prefetches QKD keys of a single link, so they are ready when the protocol needs them.
+// Requests respect the limits the KME reports on its status endpoint.
+// Keys are erased from memory once they are taken from the pool or the pool is closed.
+type KeyPool struct {
+	link       QKDLink
+	client     *ETSIClient
+	additional []string // Additional slave SAE IDs that receive every key of the pool.
+	size       int      // Number of keys kept ready, 0 fetches keys only when they are needed.
+	noStatus   bool     // The KME does not implement the status endpoint, so its limits are unknown.
+
+	mu       sync.Mutex
+	keys     []pooledKey
+	waiting  int   // Number of callers waiting in Take.
+	closed   bool  // Set by Close, Take returns ErrPoolClosed.
+	err      error // Last error of the prefetching, after the retry policy gave up.
+	failures int   // Number of times the prefetching gave up, so Take can tell whether it failed while waiting.
+	wake     chan struct{}
+	ready    chan struct{}
+	cancel   context.CancelFunc
+}
+
+func NewKeyPool(link QKDLink, client *ETSIClient, additional []string, size int) *KeyPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &KeyPool{
+		link:       link,
+		client:     client,
+		additional: additional,
+		size:       size,
+		wake:       make(chan struct{}, 1),
+		ready:      make(chan struct{}, 1),
+		cancel:     cancel,
+	}
+	go p.run(ctx)
+	return p
+}
+
+// Create the key pool for the link, using the pool size from the qkd section of the configuration.
+func (c *BaseConfig) QKDPool(link QKDLink) *KeyPool {
+	var additional []string
+	if link == QKDLinkCluster {
+		additional = c.AdditionalSlaveSAEIDs()
+	}
+	return NewKeyPool(link, c.QKDClient(link), additional, c.QKD.KeyPoolSize())
+}
+
+// Number of keys ready in the pool.
+func (p *KeyPool) Depth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.keys)
+}
+
+// Take the oldest key from the pool, waiting for the KME if the pool is empty.
+// The key is returned together with its ID and is no longer in the pool, the caller erases it once it is used.
+// Fails when the KME does not deliver a key within the retry policy while we wait, or when the context ends.
+func (p *KeyPool) Take(ctx context.Context) ([]byte, string, error) {
+	p.mu.Lock()
+	p.waiting++
+	failures := p.failures
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.waiting--
+		p.mu.Unlock()
+	}()
+
+	for {
+		p.mu.Lock()
+		if len(p.keys) > 0 {
+			k := p.keys[0]
+			p.keys[0] = pooledKey{}
+			p.keys = p.keys[1:]
+			depth := len(p.keys)
+			p.mu.Unlock()
+
+			p.signal(p.wake)
+			if depth > 0 {
+				// Let the next waiting caller take one of the remaining keys.
+				p.signal(p.ready)
+			}
+			LogCrypto(fmt.Sprintf("Took QKD key %s from the %s pool, %d left", k.id, p.link, depth))
+			return k.key, k.id, nil
+		}
+		var err error
+		switch {
+		case p.closed:
+			err = ErrPoolClosed
+		case p.failures != failures:
+			err = p.err
+		}
+		p.mu.Unlock()
+
+		if err != nil {
+			// Let the other waiting callers see the error too.
+			p.signal(p.ready)
+			return nil, "", err
+		}
+		p.signal(p.wake)
+
+		select {
+		case <-p.ready:
+		case <-ctx.Done():
+			return nil, "", fmt.Errorf("waiting for a %s QKD key: %w", p.link, ctx.Err())
+		}
+	}
+}
+
+// Stop prefetching and erase the keys left in the pool. Callers waiting in Take get ErrPoolClosed.
+func (p *KeyPool) Close() {
+	p.cancel()
+
+	p.mu.Lock()
+	for _, k := range p.keys {
+		erase(k.key)
+	}
+	p.keys = nil
+	p.closed = true
+	p.mu.Unlock()
+	p.signal(p.ready)
+}
+
+// Keep the pool filled until it is closed. When the KME keeps failing until the retry policy gives up,
+// the error is handed to the callers waiting in Take, and we only try again once a key is asked for.
+func (p *KeyPool) run(ctx context.Context) {
+	for {
+		missing := p.missing()
+		if missing <= 0 {
+			select {
+			case <-p.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		var keys []pooledKey
+		err := p.client.retry.run(ctx, fmt.Sprintf("Prefetching %s QKD keys", p.link), func(ctx context.Context) error {
+			var err error
+			keys, err = p.fetch(ctx, missing)
+			return err
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			p.mu.Lock()
+			p.err = err
+			p.failures++
+			p.mu.Unlock()
+			p.signal(p.ready)
+
+			select {
+			case <-p.wake:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		p.mu.Lock()
+		p.keys = append(p.keys, keys...)
+		p.mu.Unlock()
+		p.signal(p.ready)
+	}
+}
+
+// Number of keys we have to fetch to fill the pool and serve everybody who is waiting.
+func (p *KeyPool) missing() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return max(p.size, p.waiting) - len(p.keys)
+}
+
+// Fetch up to n keys, as many as the KME allows in a single request and has ready.
+// Fails with ErrKMEExhausted when the KME has none ready.
+func (p *KeyPool) fetch(ctx context.Context, n int) ([]pooledKey, error) {
+	if !p.noStatus {
+		status, err := p.client.Status(ctx)
+		var etsiErr *ETSIError
+		switch {
+		case errors.As(err, &etsiErr) && etsiErr.StatusCode == http.StatusNotFound:
+			LogInfo(fmt.Sprintf("KME of the %s link has no status endpoint, requesting keys without knowing its limits", p.link))
+			p.noStatus = true
+		case err != nil:
+			return nil, err
+		default:
+			if status.MaxKeyPerRequest > 0 {
+				n = min(n, status.MaxKeyPerRequest)
+			}
+			if status.StoredKeyCount <= 0 {
+				return nil, fmt.Errorf("%w for the %s link", ErrKMEExhausted, p.link)
+			}
+			n = min(n, status.StoredKeyCount)
+		}
+	}
+
+	keys, err := p.client.GetKeys(ctx, KeyRequest{
+		Number:                n,
+		Size:                  p.client.keySize * 8,
+		AdditionalSlaveSAEIDs: p.additional,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pooled := make([]pooledKey, 0, len(keys))
+	for _, k := range keys {
+		key, err := DecodeQKDKey(k.Key, p.client.keySize)
+		if err != nil {
+			for _, k := range pooled {
+				erase(k.key)
+			}
+			return nil, fmt.Errorf("KME delivered an unusable key %s: %w", k.KeyID, err)
+		}
+		pooled = append(pooled, pooledKey{id: k.KeyID, key: key})
+	}
+
+	LogCrypto(fmt.Sprintf("Prefetched %d %s QKD keys", len(pooled), p.link))
+	return pooled, nil
+}
+
+// Non-blocking notification on a channel with capacity one.
+func (p *KeyPool) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Overwrite the key material with zeros.
+func erase(key []byte) {
+	clear(key)
+}
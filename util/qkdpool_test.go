@@ -0,0 +1,129 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// KME serving random keys while it has stock, reporting the stock on its status endpoint.
+type testKME struct {
+	stock         atomic.Int32
+	statusQueries atomic.Int32
+}
+
+func (k *testKME) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/status":
+		k.statusQueries.Add(1)
+		json.NewEncoder(w).Encode(KeyStatus{StoredKeyCount: int(k.stock.Load()), MaxKeyPerRequest: 10})
+	case "/enc_keys":
+		n, _ := strconv.Atoi(r.URL.Query().Get("number"))
+		if k.stock.Add(int32(-n)) < 0 {
+			k.stock.Add(int32(n))
+			http.Error(w, `{"message": "no keys"}`, http.StatusServiceUnavailable)
+			return
+		}
+		var container KeyContainer
+		for i := range n {
+			key := make([]byte, QKDLinkCluster.KeySize())
+			rand.Read(key)
+			container.Keys = append(container.Keys, Key{KeyID: strconv.Itoa(i), Key: base64.StdEncoding.EncodeToString(key)})
+		}
+		json.NewEncoder(w).Encode(container)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestPool(t *testing.T, kme *testKME, retry RetryPolicy) *KeyPool {
+	t.Helper()
+	server := httptest.NewServer(kme)
+	t.Cleanup(server.Close)
+
+	client := NewETSIClient(server.URL, nil)
+	client.retry = retry
+	pool := NewKeyPool(QKDLinkCluster, client, nil, 0)
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+var fastRetry = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+func TestKeyPoolExhaustedKMEUsesRetryBudget(t *testing.T) {
+	kme := &testKME{}
+	pool := newTestPool(t, kme, fastRetry)
+
+	_, _, err := pool.Take(context.Background())
+	if !errors.Is(err, ErrKMEExhausted) {
+		t.Fatalf("Take() error = %v, want ErrKMEExhausted", err)
+	}
+	if got := kme.statusQueries.Load(); got != int32(fastRetry.MaxAttempts) {
+		t.Errorf("KME polled %d times, want %d", got, fastRetry.MaxAttempts)
+	}
+
+	// Once the KME has keys again, the next Take retries instead of returning the old error.
+	kme.stock.Store(1)
+	if _, _, err := pool.Take(context.Background()); err != nil {
+		t.Fatalf("Take() after the KME recovered: %v", err)
+	}
+}
+
+func TestKeyPoolTakeRespectsDeadline(t *testing.T) {
+	retry := RetryPolicy{MaxAttempts: 0, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+	pool := newTestPool(t, &testKME{}, retry)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := pool.Take(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Take() error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestKeyPoolClose(t *testing.T) {
+	pool := newTestPool(t, &testKME{}, RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+
+	done := make(chan error)
+	go func() {
+		_, _, err := pool.Take(context.Background())
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	pool.Close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrPoolClosed) {
+			t.Errorf("Take() error = %v, want ErrPoolClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Take() still waiting after Close()")
+	}
+}
+
+func TestKeyPoolTakesKeys(t *testing.T) {
+	kme := &testKME{}
+	kme.stock.Store(3)
+	pool := newTestPool(t, kme, fastRetry)
+
+	for range 3 {
+		key, _, err := pool.Take(context.Background())
+		if err != nil {
+			t.Fatalf("Take(): %v", err)
+		}
+		if len(key) != QKDLinkCluster.KeySize() || checkKeyEntropy(key) != nil {
+			t.Errorf("Take() returned an unusable key of %d bytes", len(key))
+		}
+	}
+	if kme.stock.Load() != 0 {
+		t.Errorf("%d keys left at the KME, want 0", kme.stock.Load())
+	}
+}
@@ -0,0 +1,181 @@
+package util
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Interval in which the config file is checked for changes.
+const configPollInterval = time.Second
+
+// Changes between the running configuration and the reloaded one.
+type ConfigChange struct {
+	ClusterCrypto bool     // The cluster keys, their sources or the number of members changed, so the cluster has to rekey.
+	LeaderCrypto  bool     // The leader keys, their sources or the number of clusters changed, so the leaders have to rekey.
+	Ignored       []string // Fields which only take effect after a restart. They keep their running values.
+}
+
+// Watch the config file and reload it when it is modified or when the process receives SIGHUP.
+// The reloaded configuration is validated like on start. If it is valid, apply is called with it
+// from the watching goroutine, otherwise the error is logged and the running configuration is kept.
+// Key files are not watched, send SIGHUP after replacing them.
+func WatchConfig(path string, running BaseConfig, apply func(BaseConfig, ConfigChange)) {
+	// The terminal belongs to the user interface from now on.
+	disablePassphrasePrompt()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+
+		last := configStamp(path)
+		clusterDigest, leaderDigest := running.cryptoDigests()
+		for {
+			select {
+			case <-hup:
+				LogInfo("Received SIGHUP, reloading config")
+			case <-ticker.C:
+				stamp := configStamp(path)
+				if stamp == last {
+					continue
+				}
+				last = stamp
+				LogInfo("Config file changed, reloading")
+			}
+
+			next, change, err := reloadConfig(path, running)
+			if err != nil {
+				LogError(fmt.Sprintf("Config reload failed, keeping the running configuration: %v", err))
+				continue
+			}
+			nextCluster, nextLeader := next.cryptoDigests()
+			change.ClusterCrypto = nextCluster != clusterDigest
+			change.LeaderCrypto = nextLeader != leaderDigest
+
+			running, clusterDigest, leaderDigest = next, nextCluster, nextLeader
+			apply(next, change)
+			LogInfo("Config reloaded")
+		}
+	}()
+}
+
+// Load the config file for replacing the running configuration. The fields which only change on a restart
+// are set back before validating, so the configuration is validated as it is going to run.
+func reloadConfig(path string, running BaseConfig) (BaseConfig, ConfigChange, error) {
+	next, err := readConfig(path, true)
+	if err != nil {
+		return next, ConfigChange{}, err
+	}
+	change := ConfigChange{Ignored: keepRestartFields(running, &next)}
+	if len(change.Ignored) > 0 {
+		LogError(fmt.Sprintf("Changes of %s only take effect after a restart", strings.Join(change.Ignored, ", ")))
+	}
+	if errs := next.validate(); len(errs) > 0 {
+		return next, change, logError(errs)
+	}
+	return next, change, nil
+}
+
+// Modification time and size of the file, to notice when it is written.
+func configStamp(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+}
+
+// Set the fields which cannot change while running, because they identify us to the others,
+// back to their running values in next. The names of the changed fields are returned.
+// Next is not validated yet, so its fields may be missing.
+func keepRestartFields(running BaseConfig, next *BaseConfig) []string {
+	var ignored []string
+	keep := func(name string, changed bool, restore func()) {
+		if changed {
+			ignored = append(ignored, name)
+			restore()
+		}
+	}
+
+	keep("server", running.Server != next.Server, func() { next.Server = running.Server })
+	keep("mesh", !reflect.DeepEqual(running.Mesh, next.Mesh), func() { next.Mesh = running.Mesh })
+	keep("clusterID", !equalInts(running.ClusterID, next.ClusterID), func() { next.ClusterID = running.ClusterID })
+	keep("cluster", (running.Cluster == nil) != (next.Cluster == nil), func() { next.Cluster = running.Cluster })
+	keep("leaders", (running.Leader == nil) != (next.Leader == nil), func() { next.Leader = running.Leader })
+	if running.Cluster != nil && running.Cluster != next.Cluster {
+		keep("memberID", !equalInts(running.Cluster.MemberID, next.Cluster.MemberID), func() { next.Cluster.MemberID = running.Cluster.MemberID })
+	}
+
+	return ignored
+}
+
+func equalInts(a, b *int) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+// Digests of the cryptographic inputs of the cluster and of the leaders, zero for missing sections.
+// They are taken when the configuration is loaded, so replaced key files are noticed on the next reload.
+func (c *BaseConfig) cryptoDigests() (cluster, leader [sha256.Size]byte) {
+	if c.Cluster != nil {
+		cluster = c.Cluster.cryptoDigest()
+	}
+	if c.Leader != nil {
+		leader = c.Leader.cryptoDigest()
+	}
+	return cluster, leader
+}
+
+// Digest of the inputs the Cluster Session Key is derived from. The paths and the KME endpoints
+// are not part of it, so moving a key file or switching to another KME does not need a rekey.
+func (c *ClusterConfig) cryptoDigest() [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintln(h, *c.NMembers)
+	writeFileDigest(h, c.PublicKeys)
+	writeFileDigest(h, c.Roster)
+	writeFileDigest(h, c.SecretKey)
+	writeSourceDigest(h, c.Crypto)
+	return [sha256.Size]byte(h.Sum(nil))
+}
+
+// Digest of the inputs the keys of the links between leaders are derived from.
+func (c *LeaderConfig) cryptoDigest() [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintln(h, *c.NClusters)
+	writeFileDigest(h, c.SecretKey)
+	writeSourceDigest(h, c.LeftCrypto)
+	writeSourceDigest(h, c.RightCrypto)
+	return [sha256.Size]byte(h.Sum(nil))
+}
+
+func writeSourceDigest(h hash.Hash, source *CryptoSource) {
+	if !source.IsSet() {
+		fmt.Fprintln(h, "-")
+		return
+	}
+	fmt.Fprintln(h, source.Kind, source.UsesETSI())
+	writeFileDigest(h, source.PublicKey)
+	writeFileDigest(h, source.Path)
+}
+
+func writeFileDigest(h hash.Hash, path string) {
+	if path == "" {
+		fmt.Fprintln(h, "-")
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(h, "?")
+		return
+	}
+	fmt.Fprintln(h, len(data))
+	h.Write(data)
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"slices"
+	"testing"
+)
+
+// Fields which only change on a restart are set back before the reloaded configuration is validated.
+func TestReloadConfigKeepsRestartFields(t *testing.T) {
+	psk := make([]byte, QKDLinkCluster.KeySize())
+	rand.Read(psk)
+	pskPath := writeTestFile(t, "psk.json", map[string]string{"key": base64.StdEncoding.EncodeToString(psk)})
+	rosterPath := writeTestFile(t, "roster.json", Roster{Members: []RosterMember{{ID: 0, Name: "alice"}, {ID: 1, Name: "bob"}}})
+
+	config := func(name string, clusterID *int, memberID int) BaseConfig {
+		n := 2
+		return BaseConfig{Server: "localhost:9000", Name: name, ClusterID: clusterID, Cluster: &ClusterConfig{
+			NMembers: &n,
+			MemberID: &memberID,
+			Roster:   rosterPath,
+			Crypto:   &CryptoSource{Kind: CryptoPSK, Path: pskPath},
+		}}
+	}
+	running := config("bob", new(int), 1)
+
+	tests := []struct {
+		name        string
+		next        BaseConfig
+		wantIgnored []string
+		wantErr     bool
+	}{
+		{"unchanged", config("bob", new(int), 1), nil, false},
+		{"memberID changed", config("bob", new(int), 0), []string{"memberID"}, false},
+		{"memberID and name changed", config("alice", new(int), 0), []string{"memberID"}, true},
+		{"clusterID removed", config("bob", nil, 1), []string{"clusterID"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, change, err := reloadConfig(writeTestFile(t, "config.json", tt.next), running)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reloadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(change.Ignored, tt.wantIgnored) {
+				t.Errorf("Ignored = %v, want %v", change.Ignored, tt.wantIgnored)
+			}
+			if err == nil && (*next.ClusterID != 0 || *next.Cluster.MemberID != 1) {
+				t.Errorf("reloaded cluster %d member %d, want the running cluster 0 member 1", *next.ClusterID, *next.Cluster.MemberID)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"pqgch/gake"
+	"strings"
+)
+
+const (
+	safetyNumberLabel  = "pqgch safety number v1"
+	safetyNumberGroups = 12 // Groups of 5 digits, each taken from 5 bytes of the SHA-512 hash.
+)
+
+// Roster lists the members of a cluster. The same roster file is shared by all configs in the cluster,
+// so everybody agrees on the names used as party identifiers and on the public keys.
+type Roster struct {
+	Members []RosterMember `json:"members"`
+}
+
+type RosterMember struct {
+	ID         int    `json:"id"`                   // Member ID within the cluster.
+	Name       string `json:"name"`                 // Display name, also used as the party identifier.
+	PublicKey  string `json:"publicKey,omitempty"`  // Base64 encoded Kyber KEM public key, required in Kyber-GAKE mode.
+	SigningKey string `json:"signingKey,omitempty"` // Optional base64 encoded public signing key.
+}
+
+// Load the roster and check that it lists exactly the members 0..n-1 with distinct names.
+func LoadRoster(path string, n int) (*Roster, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read roster %q: %w", path, err)
+	}
+	var roster Roster
+	if err := json.Unmarshal(data, &roster); err != nil {
+		return nil, fmt.Errorf("invalid JSON in %q: %w", path, err)
+	}
+	if len(roster.Members) != n {
+		return nil, fmt.Errorf("roster lists %d members, but nMembers is %d", len(roster.Members), n)
+	}
+
+	byID := make([]RosterMember, n)
+	names := make(map[string]bool)
+	for _, m := range roster.Members {
+		if m.ID < 0 || m.ID >= n {
+			return nil, fmt.Errorf("roster member ID %d is out of range 0..%d", m.ID, n-1)
+		}
+		if byID[m.ID].Name != "" {
+			return nil, fmt.Errorf("roster lists member %d twice", m.ID)
+		}
+		if strings.TrimSpace(m.Name) == "" {
+			return nil, fmt.Errorf("roster member %d has no name", m.ID)
+		}
+		// Names are truncated to the party identifier length, longer ones could collide.
+		if len(m.Name) > gake.PidLen {
+			return nil, fmt.Errorf("roster member %d: name %q is longer than %d bytes", m.ID, m.Name, gake.PidLen)
+		}
+		if names[m.Name] {
+			return nil, fmt.Errorf("roster lists the name %q twice", m.Name)
+		}
+		if m.PublicKey != "" {
+			if _, err := decodeKeyOfSize(m.PublicKey, gake.PkLen); err != nil {
+				return nil, fmt.Errorf("roster member %d: publicKey %v", m.ID, err)
+			}
+		}
+		if m.SigningKey != "" {
+			if _, err := base64.StdEncoding.DecodeString(m.SigningKey); err != nil {
+				return nil, fmt.Errorf("roster member %d: signingKey is not valid base64", m.ID)
+			}
+		}
+		names[m.Name] = true
+		byID[m.ID] = m
+	}
+
+	roster.Members = byID
+	return &roster, nil
+}
+
+// Get the member with the given ID.
+func (r *Roster) Member(id int) (RosterMember, bool) {
+	if r == nil || id < 0 || id >= len(r.Members) {
+		return RosterMember{}, false
+	}
+	return r.Members[id], true
+}
+
+// Get the public keys of the members, indexed by member ID.
+func (r *Roster) PublicKeys() ([][gake.PkLen]byte, error) {
+	pks := make([][gake.PkLen]byte, len(r.Members))
+	for i, m := range r.Members {
+		if m.PublicKey == "" {
+			return nil, fmt.Errorf("roster member %d has no publicKey", i)
+		}
+		raw, err := decodeKeyOfSize(m.PublicKey, gake.PkLen)
+		if err != nil {
+			return nil, fmt.Errorf("roster member %d: publicKey %v", i, err)
+		}
+		pks[i] = [gake.PkLen]byte(raw)
+	}
+	return pks, nil
+}
+
+// Check that the sender name of a message from the member matches the roster.
+func (r *Roster) CheckSender(id int, name string) error {
+	m, found := r.Member(id)
+	if !found {
+		return fmt.Errorf("member %d is not in the roster", id)
+	}
+	if m.Name != name {
+		return fmt.Errorf("sender name %q does not match the roster name %q of member %d", name, m.Name, id)
+	}
+	return nil
+}
+
+// Roster of a cluster configured by a publicKeys file, whose members have no names.
+func RosterOfPublicKeys(pks []string) *Roster {
+	roster := &Roster{}
+	for i, pk := range pks {
+		roster.Members = append(roster.Members, RosterMember{ID: i, PublicKey: pk})
+	}
+	return roster
+}
+
+// Safety number of the cluster, derived from the IDs, names and public keys of all members.
+// If the members of a cluster see the same safety number, they all have the same roster.
+// It is 60 digits in groups of 5, so it can be compared out of band, for example by phone.
+func (r *Roster) SafetyNumber() string {
+	h := sha512.New()
+	h.Write([]byte(safetyNumberLabel))
+	for _, m := range r.Members {
+		pk, _ := base64.StdEncoding.DecodeString(m.PublicKey)
+		// Lengths are included, so the fields of different members cannot be shifted into each other.
+		binary.Write(h, binary.BigEndian, uint32(m.ID))
+		binary.Write(h, binary.BigEndian, uint32(len(m.Name)))
+		h.Write([]byte(m.Name))
+		binary.Write(h, binary.BigEndian, uint32(len(pk)))
+		h.Write(pk)
+	}
+	sum := h.Sum(nil)
+
+	groups := make([]string, 0, safetyNumberGroups)
+	for i := range safetyNumberGroups {
+		var chunk [8]byte
+		copy(chunk[3:], sum[5*i:5*i+5])
+		groups = append(groups, fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk[:])%100000))
+	}
+	return strings.Join(groups, " ")
+}
+
+// Fingerprint of the public key of the member, for comparing keys out of band.
+func (m RosterMember) Fingerprint() string {
+	raw, err := base64.StdEncoding.DecodeString(m.PublicKey)
+	if m.PublicKey == "" || err != nil {
+		return "-"
+	}
+	return KeyFingerprint(raw)
+}
+
+// Fingerprint of a public key: the first 16 bytes of its SHA-256 hash in groups of 4 hex digits.
+func KeyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	digits := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+func decodeKeyOfSize(encoded string, size int) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("is not valid base64")
+	}
+	if len(raw) != size {
+		return nil, fmt.Errorf("has wrong length: expected %d, got %d", size, len(raw))
+	}
+	return raw, nil
+}
@@ -0,0 +1,160 @@
+package util
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"pqgch/gake"
+	"regexp"
+	"testing"
+)
+
+// Public key of a test member, every byte set to its ID.
+func testPublicKey(id int) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{byte(id)}, gake.PkLen))
+}
+
+func writeTestFile(t *testing.T, name string, contents any) string {
+	t.Helper()
+	data, err := json.Marshal(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRoster(t *testing.T) {
+	member := func(id int, name string) RosterMember {
+		return RosterMember{ID: id, Name: name, PublicKey: testPublicKey(id)}
+	}
+
+	tests := []struct {
+		name    string
+		members []RosterMember
+		wantErr bool
+	}{
+		{"valid", []RosterMember{member(0, "alice"), member(1, "bob")}, false},
+		{"out of order", []RosterMember{member(1, "bob"), member(0, "alice")}, false},
+		{"without public keys", []RosterMember{{ID: 0, Name: "alice"}, {ID: 1, Name: "bob"}}, false},
+		{"too few members", []RosterMember{member(0, "alice")}, true},
+		{"too many members", []RosterMember{member(0, "alice"), member(1, "bob"), member(2, "carol")}, true},
+		{"ID out of range", []RosterMember{member(0, "alice"), member(2, "bob")}, true},
+		{"duplicate ID", []RosterMember{member(0, "alice"), member(0, "bob")}, true},
+		{"missing name", []RosterMember{member(0, "alice"), member(1, " ")}, true},
+		{"duplicate name", []RosterMember{member(0, "alice"), member(1, "alice")}, true},
+		{"name longer than the party identifier", []RosterMember{member(0, "alice"), member(1, string(bytes.Repeat([]byte("b"), gake.PidLen+1)))}, true},
+		{"public key of the wrong size", []RosterMember{member(0, "alice"), {ID: 1, Name: "bob", PublicKey: base64.StdEncoding.EncodeToString([]byte("short"))}}, true},
+		{"invalid signing key", []RosterMember{member(0, "alice"), {ID: 1, Name: "bob", SigningKey: "not base64!"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, "roster.json", Roster{Members: tt.members})
+			roster, err := LoadRoster(path, 2)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadRoster() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			for id, m := range roster.Members {
+				if m.ID != id {
+					t.Errorf("Members[%d] has ID %d, want the members ordered by ID", id, m.ID)
+				}
+			}
+		})
+	}
+
+	if _, err := LoadRoster(filepath.Join(t.TempDir(), "missing.json"), 2); err == nil {
+		t.Error("LoadRoster() of a missing file succeeded")
+	}
+}
+
+// Unreadable member files are reported as errors, so a reload can keep the running configuration.
+func TestLoadMembers(t *testing.T) {
+	roster := writeTestFile(t, "roster.json", Roster{Members: []RosterMember{
+		{ID: 0, Name: "alice", PublicKey: testPublicKey(0)},
+		{ID: 1, Name: "bob", PublicKey: testPublicKey(1)},
+	}})
+	publicKeys := writeTestFile(t, "public_keys.json", map[string][]string{"publicKeys": {testPublicKey(0), testPublicKey(1)}})
+	missing := filepath.Join(t.TempDir(), "missing.json")
+	n := 2
+
+	tests := []struct {
+		name       string
+		config     ClusterConfig
+		wantRoster bool
+		wantKeys   bool
+		wantErr    bool
+	}{
+		{"roster", ClusterConfig{NMembers: &n, Roster: roster}, true, true, false},
+		{"publicKeys file", ClusterConfig{NMembers: &n, PublicKeys: publicKeys}, false, true, false},
+		{"roster without Kyber", ClusterConfig{NMembers: &n, Roster: roster, Crypto: &CryptoSource{Kind: CryptoPSK, Path: "psk.json"}}, true, false, false},
+		{"missing roster", ClusterConfig{NMembers: &n, Roster: missing}, false, false, true},
+		{"missing publicKeys file", ClusterConfig{NMembers: &n, PublicKeys: missing}, false, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			members, err := tt.config.LoadMembers()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadMembers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (members.Roster != nil) != tt.wantRoster {
+				t.Errorf("Roster = %v, want a roster %v", members.Roster, tt.wantRoster)
+			}
+			if (members.PublicKeys != nil) != tt.wantKeys {
+				t.Errorf("%d public keys, want public keys %v", len(members.PublicKeys), tt.wantKeys)
+			}
+			if tt.wantKeys && members.PublicKeys[1] != [gake.PkLen]byte(bytes.Repeat([]byte{1}, gake.PkLen)) {
+				t.Error("PublicKeys[1] is not the key of member 1")
+			}
+			if verification := members.VerificationRoster(); (verification != nil) != tt.wantKeys {
+				t.Errorf("VerificationRoster() = %v, want a roster %v", verification, tt.wantKeys)
+			}
+		})
+	}
+}
+
+// The safety number is the same for the same roster and changes with every ID, name and public key in it.
+func TestSafetyNumber(t *testing.T) {
+	roster := func() *Roster {
+		return &Roster{Members: []RosterMember{
+			{ID: 0, Name: "alice", PublicKey: testPublicKey(0)},
+			{ID: 1, Name: "bob", PublicKey: testPublicKey(1)},
+		}}
+	}
+	want := roster().SafetyNumber()
+	if !regexp.MustCompile(`^\d{5}( \d{5}){11}$`).MatchString(want) {
+		t.Fatalf("SafetyNumber() = %q, want 12 groups of 5 digits", want)
+	}
+	if got := roster().SafetyNumber(); got != want {
+		t.Errorf("SafetyNumber() = %q for the same roster, want %q", got, want)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(r *Roster)
+	}{
+		{"ID", func(r *Roster) { r.Members[1].ID = 2 }},
+		{"name", func(r *Roster) { r.Members[1].Name = "bobby" }},
+		{"public key", func(r *Roster) { r.Members[1].PublicKey = testPublicKey(2) }},
+		{"name moved between members", func(r *Roster) { r.Members[0].Name, r.Members[1].Name = "alicebob", "" }},
+		{"without names", func(r *Roster) { r.Members[0].Name, r.Members[1].Name = "", "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := roster()
+			tt.modify(r)
+			if got := r.SafetyNumber(); got == want {
+				t.Errorf("SafetyNumber() did not change with the %s", tt.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type MessageSender interface {
+	Send(msg Message)
+}
+
+// StreamTransport exchanges newline delimited JSON messages over a byte stream.
+// It is used for TCP and Unix socket connections, as well as for the standard input and output.
+type StreamTransport struct {
+	r           io.Reader
+	w           io.Writer
+	mu          sync.Mutex
+	receiveChan chan Message
+}
+
+func newStreamTransport(r io.Reader, w io.Writer, receiveChan chan Message, clientID, clusterID int) *StreamTransport {
+	t := &StreamTransport{
+		r:           r,
+		w:           w,
+		receiveChan: receiveChan,
+	}
+
+	go t.listen()
+	go pingPong(t, clientID, clusterID)
+
+	return t
+}
+
+// Periodically send a Ping message, so the routing server keeps the connection alive.
+func pingPong(sender MessageSender, clientID, clusterID int) {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ping := Message{
+			SenderID:  clientID,
+			ClusterID: clusterID,
+			To:        ToServer(),
+			Type:      Ping,
+		}
+		sender.Send(ping)
+	}
+}
+
+// Pass the message received from the routing server to the session.
+// Keepalive responses are dropped and errors reported by the server are fatal.
+func dispatch(msg Message, receiveChan chan Message) {
+	if msg.Type == Pong {
+		return
+	}
+	if msg.Type == Error {
+		ExitWithMsg("From routing server: " + msg.Content)
+	}
+	if msg.Type != TextMsg {
+		LogRouteWithNames("RECEIVED", msg.TypeName(), "from", msg.SenderName)
+	}
+	receiveChan <- msg
+}
+
+func (t *StreamTransport) listen() {
+	reader := NewMessageReader(t.r)
+
+	for reader.HasMessage() {
+		dispatch(reader.GetMessage(), t.receiveChan)
+	}
+}
+
+func (t *StreamTransport) Send(msg Message) {
+	if err := msg.prepareRouting(); err != nil {
+		LogError(fmt.Sprintf("Refusing to send message: %v", err))
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	msgData, err := json.Marshal(msg)
+	if err != nil {
+		LogError(fmt.Sprintf("Error marshaling message: %v", err))
+		return
+	}
+
+	msgData = append(msgData, '\n')
+
+	_, err = t.w.Write(msgData)
+	if err != nil {
+		ExitWithMsg(fmt.Sprintf("failed to send message: %v", err))
+	}
+}
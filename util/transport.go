@@ -0,0 +1,31 @@
+package util
+
+import (
+	"strings"
+)
+
+// Connect to the other participants using the transport selected by the configuration.
+// In mesh mode the participants connect directly to each other. Otherwise we connect to the routing server
+// according to the scheme of its address:
+//   - ws:// or wss:// - WebSocket,
+//   - unix:///path/to/socket - Unix domain socket,
+//   - stdio: - standard input and output,
+//   - anything else is treated as a plain TCP address.
+func NewTransport(config BaseConfig, receiveChan chan Message) (MessageSender, error) {
+	if config.Mesh != nil {
+		return NewMeshTransport(*config.Mesh, receiveChan)
+	}
+
+	clientID, clusterID := config.GetMemberID(), *config.ClusterID
+	low := strings.ToLower(config.Server)
+	switch {
+	case strings.HasPrefix(low, "ws://") || strings.HasPrefix(low, "wss://"):
+		return NewWSTransport(config.Server, receiveChan, clientID, clusterID)
+	case unixSocketPath(config.Server) != "":
+		return NewUnixTransport(unixSocketPath(config.Server), receiveChan, clientID, clusterID)
+	case IsStdioAddress(config.Server):
+		return NewStdioTransport(receiveChan, clientID, clusterID), nil
+	default:
+		return NewTCPTransport(config.Server, receiveChan, clientID, clusterID)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"slices"
+	"strings"
 
 	"golang.org/x/term"
 )
@@ -70,14 +72,21 @@ func PrintLineColored(msg string, color Color) {
 }
 
 func ExitWithMsg(msg string) {
-	clearLine()
 	header := colorize("[ERROR] ", ColorRed)
 	content := colorize(msg, ColorRed)
+	if oldState == nil {
+		fmt.Fprintln(os.Stderr, header+content)
+		os.Exit(1)
+	}
+	clearLine()
 	fmt.Println(header + content)
 	exit()
 }
 
 func exit() {
+	if oldState == nil {
+		os.Exit(0)
+	}
 	term.Restore(int(os.Stdin.Fd()), oldState)
 	fmt.Print("\r")
 	fmt.Print(cursorShow)
@@ -106,9 +115,60 @@ func clearLine() {
 	fmt.Print("\r" + clearLineCode)
 }
 
-var oldState *term.State
+var oldState *term.State // Terminal state before entering raw mode, nil when the TUI is not running.
+
+// Run without the terminal user interface, for example when the standard input and output carry the messages.
+// Logs and received text messages are written to the standard error output, there is no way to send text.
+func StartHeadless() {
+	for {
+		select {
+		case log := <-logChan:
+			fmt.Fprintln(os.Stderr, log)
+		case msg := <-msgChan:
+			fmt.Fprintln(os.Stderr, msg)
+		}
+	}
+}
+
+// Command the user can type as /<Name> [args] instead of a text message.
+type TUICommand struct {
+	Name string
+	Help string
+	Run  func(args string) // Run in its own goroutine, so it can print while the user interface keeps running.
+}
+
+// Report whether the line is /help or one of the commands. Any other line is a text message, even if it starts with a slash.
+func isCommand(line string, commands []TUICommand) bool {
+	name, found := strings.CutPrefix(line, "/")
+	if !found {
+		return false
+	}
+	name, _, _ = strings.Cut(name, " ")
+	return name == "help" || slices.ContainsFunc(commands, func(c TUICommand) bool { return c.Name == name })
+}
 
-func StartTUI(onLine func(string)) {
+// Run the command typed as a line starting with a slash in its own goroutine. /help lists the commands.
+func runCommand(line string, commands []TUICommand) {
+	name, args, _ := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	go func() {
+		if name == "help" {
+			PrintLine("/help - list the commands")
+			for _, c := range commands {
+				PrintLine(fmt.Sprintf("/%s - %s", c.Name, c.Help))
+			}
+			PrintLine("Start a message with // to send text beginning with a command")
+			return
+		}
+		for _, c := range commands {
+			if c.Name == name {
+				c.Run(strings.TrimSpace(args))
+				return
+			}
+		}
+	}()
+}
+
+func StartTUI(onLine func(string), commands ...TUICommand) {
 	var err error
 	oldState, err = term.MakeRaw(int(os.Stdin.Fd()))
 	if err != nil {
@@ -167,10 +227,18 @@ func StartTUI(onLine func(string)) {
 					continue
 				}
 				clearLine()
-				log := "You: " + string(input)
-				fmt.Fprintln(os.Stdout, colorize(log, ColorGreen))
-
-				onLine(string(input))
+				line := string(input)
+				if isCommand(line, commands) {
+					fmt.Fprintln(os.Stdout, colorize(line, ColorWhite))
+					runCommand(line, commands)
+				} else {
+					// A command escaped with a second slash is sent as text starting with a single slash.
+					if strings.HasPrefix(line, "//") && isCommand(line[1:], commands) {
+						line = line[1:]
+					}
+					fmt.Fprintln(os.Stdout, colorize("You: "+line, ColorGreen))
+					onLine(line)
+				}
 
 				input = []rune{}
 				printPrompt("")
@@ -0,0 +1,27 @@
+package util
+
+import "testing"
+
+func TestIsCommand(t *testing.T) {
+	commands := []TUICommand{{Name: "verify"}}
+
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"/verify", true},
+		{"/verify all", true},
+		{"/help", true},
+		{"/etc/hosts", false},
+		{"/verifying", false},
+		{"//verify", false},
+		{"verify", false},
+		{"/", false},
+	}
+
+	for _, tt := range tests {
+		if got := isCommand(tt.line, commands); got != tt.want {
+			t.Errorf("isCommand(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// WSTransport talks to the routing server over a WebSocket connection.
+// Every frame carries exactly one JSON encoded Message.
+type WSTransport struct {
+	conn        *websocket.Conn
+	mu          sync.Mutex
+	receiveChan chan Message
+}
+
+func NewWSTransport(address string, receiveChan chan Message, clientID, clusterID int) (*WSTransport, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebSocket URL %q: %w", address, err)
+	}
+
+	origin := "http://" + u.Host
+	if u.Scheme == "wss" {
+		origin = "https://" + u.Host
+	}
+
+	conn, err := websocket.Dial(address, "", origin)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &WSTransport{
+		conn:        conn,
+		receiveChan: receiveChan,
+	}
+
+	go t.listen()
+	go pingPong(t, clientID, clusterID)
+
+	return t, nil
+}
+
+func (t *WSTransport) listen() {
+	for {
+		var msg Message
+		err := websocket.JSON.Receive(t.conn, &msg)
+		if err == io.EOF {
+			LogInfo("Connection closed")
+			return
+		}
+		if err != nil {
+			LogError(fmt.Sprintf("Error reading from connection: %v", err))
+			return
+		}
+		dispatch(msg, t.receiveChan)
+	}
+}
+
+func (t *WSTransport) Send(msg Message) {
+	if err := msg.prepareRouting(); err != nil {
+		LogError(fmt.Sprintf("Refusing to send message: %v", err))
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err := websocket.JSON.Send(t.conn, msg)
+	if err != nil {
+		ExitWithMsg(fmt.Sprintf("failed to send message: %v", err))
+	}
+}